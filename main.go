@@ -16,5 +16,8 @@ func main() {
 	}
 	defer r.Close()
 	server := api.NewApi(r, config.Dasboard)
+	if len(config.TLS.Listen) > 0 {
+		go server.StartTLS(config.TLS.Listen, r.TLSConfig())
+	}
 	server.Start(":8081")
 }
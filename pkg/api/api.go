@@ -2,11 +2,15 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 	"warptail/pkg/router"
 	"warptail/pkg/utils"
 
@@ -19,6 +23,8 @@ type apiCtx string
 
 const ROUTECTX = apiCtx("route")
 
+const DEFAULT_LOG_LIMIT = 100
+
 type api struct {
 	*router.Router
 	*chi.Mux
@@ -38,13 +44,16 @@ func NewApi(router *router.Router, config utils.DashboardConfig) *api {
 	}
 	// Add middlewares
 	api.Mux.Use(middleware.RequestID)
+	api.Mux.Use(middleware.Recoverer)
+	// proxied traffic is passed through as is and logged per route, only the
+	// dashboard is compressed and logged here. RealIP comes after the proxy
+	// as it believes X-Forwarded-For from anyone, routes only take it from
+	// trusted proxies.
+	api.Mux.Use(api.proxy)
 	api.Mux.Use(middleware.RealIP)
 	api.Mux.Use(middleware.Logger)
-	api.Mux.Use(middleware.Recoverer)
 	api.Mux.Use(middleware.Compress(5))
 
-	api.Mux.Use(api.proxy)
-
 	api.Mux.Use(cors.Handler(cors.Options{
 		AllowOriginFunc: func(r *http.Request, origin string) bool { return true },
 		AllowedMethods:  []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
@@ -70,6 +79,7 @@ func NewApi(router *router.Router, config utils.DashboardConfig) *api {
 			r.Get("/dashboard", api.handleDashboardSettings)
 			r.Post("/dashboard", api.handleUpdateDashboardSettings)
 		})
+		r.Get("/api/events", api.handleEvents)
 		r.Route("/api/routes", func(r chi.Router) {
 			r.Get("/", api.handleGetRoutes)
 			r.Post("/", api.handleCreateRoute)
@@ -78,6 +88,7 @@ func NewApi(router *router.Router, config utils.DashboardConfig) *api {
 			r.Use(api.RouteCtx)
 			r.Get("/", api.handleGetRoute)
 			r.Get("/timeseries", api.handleTimeseries)
+			r.Get("/logs", api.handleLogs)
 			r.Post("/stop", api.handleStopRoute)
 			r.Post("/start", api.handleStartRoute)
 			r.Put("/", api.handleUpdateRoute)
@@ -90,6 +101,10 @@ func NewApi(router *router.Router, config utils.DashboardConfig) *api {
 
 func (api *api) proxy(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acme := api.ACMEHandler(); acme != nil && strings.HasPrefix(r.URL.Path, router.ACME_CHALLENGE_PATH) {
+			acme.ServeHTTP(w, r)
+			return
+		}
 		host := r.Host
 		if colonIndex := strings.Index(host, ":"); colonIndex != -1 {
 			host = host[:colonIndex]
@@ -100,12 +115,26 @@ func (api *api) proxy(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		if route.Config().Type != utils.HTTP {
+		clientIP := api.ClientIP(r)
+		r = router.WithClientIP(r, clientIP)
+		switch route := route.(type) {
+		case *router.HTTPSRoute:
+			if !route.Allow(w, r) {
+				return
+			}
+			if r.TLS == nil {
+				http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+				return
+			}
+			route.Handle(w, r)
+		case *router.HTTPRoute:
+			if !route.Allow(w, r) {
+				return
+			}
+			route.Handle(w, r)
+		default:
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
 		}
-		httpRoute := route.(*router.HTTPRoute)
-		httpRoute.Handle(w, r)
 	})
 }
 
@@ -114,6 +143,16 @@ func (api *api) Start(addr string) {
 	log.Println(http.ListenAndServe(addr, api))
 }
 
+func (api *api) StartTLS(addr string, config *tls.Config) {
+	log.Printf("Starting TLS listener on %s", addr)
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   api,
+		TLSConfig: config,
+	}
+	log.Println(server.ListenAndServeTLS("", ""))
+}
+
 func (api *api) RouteCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		routeID := chi.URLParam(r, "routeID")
@@ -165,13 +204,72 @@ func (api *api) handleTimeseries(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(route.Stats)
 }
 
+func (api *api) handleLogs(w http.ResponseWriter, r *http.Request) {
+	route, ok := r.Context().Value(ROUTECTX).(router.RouteInfo)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	filter, err := parseLogFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logs := api.GetRoute(route.Id)
+	if logs == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logs.AccessLog().Query(filter))
+}
+
+// parseLogFilter reads an access log filter from the query string, e.g.
+// ?status=5xx&method=GET&client=1.2.3.4&country=NL&path=/api&since=2024-01-02T15:04:05Z&limit=50
+func parseLogFilter(query url.Values) (utils.AccessLogFilter, error) {
+	filter := utils.AccessLogFilter{
+		Event:    utils.AccessLogEvent(query.Get("event")),
+		Method:   query.Get("method"),
+		Status:   query.Get("status"),
+		ClientIP: query.Get("client"),
+		Country:  query.Get("country"),
+		Path:     query.Get("path"),
+		Limit:    DEFAULT_LOG_LIMIT,
+	}
+	var err error
+	if since := query.Get("since"); len(since) > 0 {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if until := query.Get("until"); len(until) > 0 {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, fmt.Errorf("invalid until: %v", err)
+		}
+	}
+	if limit := query.Get("limit"); len(limit) > 0 {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			return filter, fmt.Errorf("invalid limit: %v", err)
+		}
+	}
+	return filter, nil
+}
+
 func (api *api) handleUpdateRoute(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	decoder := json.NewDecoder(r.Body)
 	var route utils.RouteConfig
 	decoder.Decode(&route)
-	api.UpdateRoute(route)
-	json.NewEncoder(w).Encode(api.GetRoute(route.Id).Config())
+	if err := api.UpdateRoute(route); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	updated := api.GetRoute(route.Id)
+	if updated == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(updated.Config())
 }
 
 func (api *api) handleDeleteRoute(w http.ResponseWriter, r *http.Request) {
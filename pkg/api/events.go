@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"warptail/pkg/router"
+)
+
+// EVENT_KEEPALIVE is how often an idle event stream gets a comment so
+// proxies in between do not time it out.
+const EVENT_KEEPALIVE = 15 * time.Second
+
+// handleEvents streams router events as server-sent events. The stream can
+// be narrowed down with ?route=<id> and ?type=route_status,traffic.
+func (api *api) handleEvents(w http.ResponseWriter, r *http.Request) {
+	route := r.URL.Query().Get("route")
+	types := map[router.EventType]bool{}
+	for _, t := range strings.Split(r.URL.Query().Get("type"), ",") {
+		if t = strings.TrimSpace(t); len(t) > 0 {
+			types[router.EventType(t)] = true
+		}
+	}
+
+	events, unsubscribe := api.Events().Subscribe()
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(EVENT_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event := <-events:
+			if len(route) > 0 && event.Route != route {
+				continue
+			}
+			if len(types) > 0 && !types[event.Type] {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -3,6 +3,8 @@ package kubeController
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"strings"
 	"warptail/pkg/utils"
 
 	networkingv1 "k8s.io/api/networking/v1"
@@ -32,20 +34,7 @@ func (ctrl *K8Controller) buildIngress(routes []utils.RouteConfig) networkingv1.
 			Host: route.Name,
 			IngressRuleValue: networkingv1.IngressRuleValue{
 				HTTP: &networkingv1.HTTPIngressRuleValue{
-					Paths: []networkingv1.HTTPIngressPath{
-						{
-							Path:     "/",
-							PathType: func() *networkingv1.PathType { pathType := networkingv1.PathTypePrefix; return &pathType }(),
-							Backend: networkingv1.IngressBackend{
-								Service: &networkingv1.IngressServiceBackend{
-									Name: ctrl.serviceName,
-									Port: networkingv1.ServiceBackendPort{
-										Number: 80,
-									},
-								},
-							},
-						},
-					},
+					Paths: ctrl.buildIngressPaths(route),
 				},
 			},
 		}
@@ -59,6 +48,69 @@ func (ctrl *K8Controller) buildIngress(routes []utils.RouteConfig) networkingv1.
 	return ingress
 }
 
+// buildIngressPaths mirrors the path rules of a route so the ingress only
+// forwards paths warptail will route, with "/" covering the route machine
+// or backends.
+func (ctrl *K8Controller) buildIngressPaths(route utils.RouteConfig) []networkingv1.HTTPIngressPath {
+	paths := []networkingv1.HTTPIngressPath{}
+	seen := map[string]bool{}
+	hasRoot := false
+	for _, rule := range route.Paths {
+		path, pathType := rule.Path, networkingv1.PathTypePrefix
+		switch rule.Match {
+		case utils.PathExact:
+			pathType = networkingv1.PathTypeExact
+		case utils.PathRegex:
+			path = regexIngressPath(rule.Path)
+		}
+		if pathType == networkingv1.PathTypePrefix && path == "/" {
+			hasRoot = true
+		}
+		if key := string(pathType) + " " + path; !seen[key] {
+			seen[key] = true
+			paths = append(paths, ctrl.buildIngressPath(path, pathType))
+		}
+	}
+	if !hasRoot && (len(route.Backends) > 0 || len(route.Machine.Address) > 0 || len(paths) == 0) {
+		paths = append(paths, ctrl.buildIngressPath("/", networkingv1.PathTypePrefix))
+	}
+	return paths
+}
+
+// regexIngressPath is the prefix an ingress forwards for a path regex.
+// Ingress paths have to start with "/", so it is the literal start of an
+// anchored regex up to its last "/" and "/" for anything else; warptail
+// applies the regex itself.
+func regexIngressPath(pattern string) string {
+	if !strings.HasPrefix(pattern, "^") {
+		return "/"
+	}
+	regex, err := regexp.Compile(strings.TrimPrefix(pattern, "^"))
+	if err != nil {
+		return "/"
+	}
+	prefix, _ := regex.LiteralPrefix()
+	if !strings.HasPrefix(prefix, "/") {
+		return "/"
+	}
+	return prefix[:strings.LastIndex(prefix, "/")+1]
+}
+
+func (ctrl *K8Controller) buildIngressPath(path string, pathType networkingv1.PathType) networkingv1.HTTPIngressPath {
+	return networkingv1.HTTPIngressPath{
+		Path:     path,
+		PathType: &pathType,
+		Backend: networkingv1.IngressBackend{
+			Service: &networkingv1.IngressServiceBackend{
+				Name: ctrl.serviceName,
+				Port: networkingv1.ServiceBackendPort{
+					Number: 80,
+				},
+			},
+		},
+	}
+}
+
 func (ctrl *K8Controller) getIngress() (*networkingv1.Ingress, error) {
 	return ctrl.k8Client.NetworkingV1().Ingresses(ctrl.namespace).Get(context.TODO(), INGRESS_NAME, metav1.GetOptions{})
 }
@@ -32,9 +32,14 @@ func (ctrl *K8Controller) buildService(routes []utils.RouteConfig) corev1.Servic
 			continue
 		}
 		port := corev1.ServicePort{
+			Name:       fmt.Sprintf("%s-%d", route.Type, route.Port),
+			Protocol:   corev1.ProtocolTCP,
 			Port:       int32(route.Port),
 			TargetPort: intstr.FromInt(route.Port),
 		}
+		if route.Type == utils.UDP {
+			port.Protocol = corev1.ProtocolUDP
+		}
 		service.Spec.Ports = append(service.Spec.Ports, port)
 	}
 	return service
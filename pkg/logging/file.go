@@ -0,0 +1,119 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"warptail/pkg/utils"
+)
+
+const (
+	DEFAULT_MAX_SIZE_MB = 100
+	// rotatedTimeFormat has nanoseconds so rotations within the same
+	// second do not overwrite each other. Parsing it without them also
+	// reads the names of files rotated by older versions.
+	rotatedTimeFormat  = "20060102T150405.000000000"
+	rotatedParseFormat = "20060102T150405"
+)
+
+// FileSink appends entries to a file, rotating it by size and age and
+// deleting rotated files once they are older than the max age.
+type FileSink struct {
+	config utils.LogSinkConfig
+	format Format
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func NewFileSink(config utils.LogSinkConfig, format Format) (*FileSink, error) {
+	if len(config.Path) == 0 {
+		return nil, fmt.Errorf("file log sink needs a path")
+	}
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0o755); err != nil {
+		return nil, err
+	}
+	sink := &FileSink{config: config, format: format}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (sink *FileSink) open() error {
+	file, err := os.OpenFile(sink.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sink.file = file
+	sink.size = info.Size()
+	sink.opened = time.Now()
+	return nil
+}
+
+func (sink *FileSink) maxSize() int64 {
+	size := sink.config.MaxSize
+	if size <= 0 {
+		size = DEFAULT_MAX_SIZE_MB
+	}
+	return int64(size) * 1024 * 1024
+}
+
+func (sink *FileSink) Write(entry utils.AccessLogEntry) error {
+	line := append(sink.format(entry), '\n')
+	expired := sink.config.RotateEvery > 0 && time.Since(sink.opened) > sink.config.RotateEvery
+	if sink.size > 0 && (sink.size+int64(len(line)) > sink.maxSize() || expired) {
+		if err := sink.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := sink.file.Write(line)
+	sink.size += int64(n)
+	return err
+}
+
+// rotate moves the current file aside with a timestamp suffix and starts a
+// new one.
+func (sink *FileSink) rotate() error {
+	if err := sink.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", sink.config.Path, time.Now().Format(rotatedTimeFormat))
+	if err := os.Rename(sink.config.Path, rotated); err != nil {
+		return err
+	}
+	sink.cleanup()
+	return sink.open()
+}
+
+func (sink *FileSink) cleanup() {
+	if sink.config.MaxAge <= 0 {
+		return
+	}
+	files, err := filepath.Glob(sink.config.Path + ".*")
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		suffix := strings.TrimPrefix(file, sink.config.Path+".")
+		rotatedAt, err := time.ParseInLocation(rotatedParseFormat, suffix, time.Local)
+		if err != nil || time.Since(rotatedAt) < sink.config.MaxAge {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			log.Printf("unable to remove old access log %s: %v", file, err)
+		}
+	}
+}
+
+func (sink *FileSink) Close() error {
+	return sink.file.Close()
+}
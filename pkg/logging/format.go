@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"warptail/pkg/utils"
+)
+
+// Format renders an entry as a single line without the trailing newline.
+type Format func(entry utils.AccessLogEntry) []byte
+
+func formatter(format utils.LogFormat) (Format, error) {
+	switch format {
+	case "", utils.JSONLogFormat:
+		return formatJSON, nil
+	case utils.CommonLogFormat:
+		return formatCommon, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+func formatJSON(entry utils.AccessLogEntry) []byte {
+	line, _ := json.Marshal(entry)
+	return line
+}
+
+// formatCommon renders an entry in Common Log Format. Connection events of
+// tcp and udp routes use the event and route name as the request line and
+// "-" as status.
+func formatCommon(entry utils.AccessLogEntry) []byte {
+	request := fmt.Sprintf("%s %s %s", entry.Method, entry.Path, "HTTP/1.1")
+	status := strconv.Itoa(entry.Status)
+	if entry.Event != utils.RequestEvent {
+		request = fmt.Sprintf("%s %s %s", strings.ToUpper(string(entry.Event)), entry.Protocol, entry.Route)
+		status = "-"
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] %q %s %d",
+		orDash(entry.ClientIP),
+		orDash(entry.User),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		request,
+		status,
+		entry.BytesSent,
+	))
+}
+
+func orDash(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
+
+// writerSink writes one line per entry to an io.Writer such as stdout.
+type writerSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+}
+
+func (sink *writerSink) Write(entry utils.AccessLogEntry) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	_, err := sink.w.Write(append(sink.format(entry), '\n'))
+	return err
+}
+
+func (sink *writerSink) Close() error {
+	return nil
+}
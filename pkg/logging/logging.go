@@ -0,0 +1,132 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"warptail/pkg/utils"
+)
+
+const queueSize = 4096
+
+// Sink writes formatted access log lines to a destination.
+type Sink interface {
+	Write(entry utils.AccessLogEntry) error
+	Close() error
+}
+
+// Logger fans access log entries out to the configured sinks. Entries are
+// queued and written in the background so a slow sink never holds up
+// proxied traffic, entries are dropped when the queue is full.
+type Logger struct {
+	sinks   []Sink
+	queue   chan utils.AccessLogEntry
+	dropped atomic.Uint64
+	done    chan bool
+	once    sync.Once
+	// mu guards closed, the queue itself stays open so a Log racing
+	// Close never sends on a closed channel
+	mu     sync.RWMutex
+	closed bool
+	stop   chan bool
+}
+
+func NewLogger(config utils.LoggingConfig) (*Logger, error) {
+	logger := &Logger{
+		queue: make(chan utils.AccessLogEntry, queueSize),
+		done:  make(chan bool),
+		stop:  make(chan bool),
+	}
+	for _, cfg := range config.Sinks {
+		sink, err := newSink(cfg)
+		if err != nil {
+			logger.closeSinks()
+			return nil, err
+		}
+		logger.sinks = append(logger.sinks, sink)
+	}
+	go logger.run()
+	return logger, nil
+}
+
+func newSink(config utils.LogSinkConfig) (Sink, error) {
+	format, err := formatter(config.Format)
+	if err != nil {
+		return nil, err
+	}
+	switch config.Type {
+	case utils.FileSink:
+		return NewFileSink(config, format)
+	case utils.SyslogSink:
+		return NewSyslogSink(config, format)
+	case utils.StdoutSink:
+		return &writerSink{w: os.Stdout, format: format}, nil
+	default:
+		return nil, fmt.Errorf("unknown log sink type %q", config.Type)
+	}
+}
+
+// Log queues an entry for all sinks, entries logged after Close are
+// dropped.
+func (logger *Logger) Log(entry utils.AccessLogEntry) {
+	logger.mu.RLock()
+	defer logger.mu.RUnlock()
+	if logger.closed {
+		return
+	}
+	select {
+	case logger.queue <- entry:
+	default:
+		if logger.dropped.Add(1)%1000 == 1 {
+			log.Printf("access log queue full, %d entries dropped", logger.dropped.Load())
+		}
+	}
+}
+
+func (logger *Logger) run() {
+	defer close(logger.done)
+	for {
+		select {
+		case entry := <-logger.queue:
+			logger.write(entry)
+		case <-logger.stop:
+			// nothing is queued after stop, flush what is left
+			for {
+				select {
+				case entry := <-logger.queue:
+					logger.write(entry)
+				default:
+					logger.closeSinks()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (logger *Logger) write(entry utils.AccessLogEntry) {
+	for _, sink := range logger.sinks {
+		if err := sink.Write(entry); err != nil {
+			log.Printf("access log sink error: %v", err)
+		}
+	}
+}
+
+// Close flushes queued entries and closes every sink.
+func (logger *Logger) Close() {
+	logger.once.Do(func() {
+		logger.mu.Lock()
+		logger.closed = true
+		logger.mu.Unlock()
+		close(logger.stop)
+		<-logger.done
+	})
+}
+
+func (logger *Logger) closeSinks() {
+	for _, sink := range logger.sinks {
+		sink.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package logging
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+	"warptail/pkg/utils"
+)
+
+const (
+	DEFAULT_SYSLOG_FACILITY = 16 // local0
+	DEFAULT_SYSLOG_TAG      = "warptail"
+	syslogSeverityInfo      = 6
+)
+
+// SyslogSink sends entries as RFC 5424 messages. Stream connections use
+// octet counting framing (RFC 6587), the connection is re-established once
+// when a write fails.
+type SyslogSink struct {
+	config   utils.LogSinkConfig
+	format   Format
+	hostname string
+	conn     net.Conn
+}
+
+func NewSyslogSink(config utils.LogSinkConfig, format Format) (*SyslogSink, error) {
+	if len(config.Address) == 0 {
+		return nil, fmt.Errorf("syslog log sink needs an address")
+	}
+	if len(config.Network) == 0 {
+		config.Network = "udp"
+	}
+	if config.Facility == 0 {
+		config.Facility = DEFAULT_SYSLOG_FACILITY
+	}
+	if len(config.Tag) == 0 {
+		config.Tag = DEFAULT_SYSLOG_TAG
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	sink := &SyslogSink{config: config, format: format, hostname: hostname}
+	if err := sink.connect(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (sink *SyslogSink) connect() error {
+	conn, err := net.DialTimeout(sink.config.Network, sink.config.Address, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("unable to connect to syslog: %v", err)
+	}
+	sink.conn = conn
+	return nil
+}
+
+func (sink *SyslogSink) stream() bool {
+	return sink.config.Network == "tcp" || sink.config.Network == "tcp4" || sink.config.Network == "tcp6" || sink.config.Network == "unix"
+}
+
+func (sink *SyslogSink) message(entry utils.AccessLogEntry) []byte {
+	priority := sink.config.Facility*8 + syslogSeverityInfo
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		priority,
+		entry.Time.Format(time.RFC3339Nano),
+		sink.hostname,
+		sink.config.Tag,
+		os.Getpid(),
+		entry.Event,
+		sink.format(entry),
+	)
+	if sink.stream() {
+		return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+	}
+	return []byte(msg)
+}
+
+func (sink *SyslogSink) Write(entry utils.AccessLogEntry) error {
+	msg := sink.message(entry)
+	if sink.conn != nil {
+		if _, err := sink.conn.Write(msg); err == nil {
+			return nil
+		}
+		sink.conn.Close()
+		sink.conn = nil
+	}
+	if err := sink.connect(); err != nil {
+		return err
+	}
+	_, err := sink.conn.Write(msg)
+	return err
+}
+
+func (sink *SyslogSink) Close() error {
+	if sink.conn == nil {
+		return nil
+	}
+	return sink.conn.Close()
+}
@@ -0,0 +1,191 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"warptail/pkg/utils"
+)
+
+var ErrAccessDenied = errors.New("client address is not allowed")
+
+// prefixList is a set of address ranges, single addresses are stored as
+// a full length prefix.
+type prefixList []netip.Prefix
+
+func parsePrefixes(entries []string) (prefixList, error) {
+	list := make(prefixList, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %q: %v", entry, err)
+			}
+			list = append(list, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %v", entry, err)
+		}
+		addr = addr.Unmap()
+		list = append(list, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return list, nil
+}
+
+func (list prefixList) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range list {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessList decides which clients may use a route.
+type accessList struct {
+	allow          prefixList
+	deny           prefixList
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+	allowASNs      map[uint]bool
+	denyASNs       map[uint]bool
+	geo            *GeoIP
+}
+
+func newAccessList(config utils.AccessConfig, geo *GeoIP) (*accessList, error) {
+	allow, err := parsePrefixes(config.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parsePrefixes(config.Deny)
+	if err != nil {
+		return nil, err
+	}
+	list := &accessList{
+		allow:          allow,
+		deny:           deny,
+		allowCountries: countrySet(config.AllowCountries),
+		denyCountries:  countrySet(config.DenyCountries),
+		allowASNs:      asnSet(config.AllowASNs),
+		denyASNs:       asnSet(config.DenyASNs),
+		geo:            geo,
+	}
+	if (len(list.allowCountries) > 0 || len(list.denyCountries) > 0) && (geo == nil || geo.countries == nil) {
+		return nil, fmt.Errorf("country rules need geoip.country_database")
+	}
+	if (len(list.allowASNs) > 0 || len(list.denyASNs) > 0) && (geo == nil || geo.asns == nil) {
+		return nil, fmt.Errorf("asn rules need geoip.asn_database")
+	}
+	return list, nil
+}
+
+func countrySet(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		set[strings.ToUpper(strings.TrimSpace(code))] = true
+	}
+	return set
+}
+
+func asnSet(asns []uint) map[uint]bool {
+	set := make(map[uint]bool, len(asns))
+	for _, asn := range asns {
+		set[asn] = true
+	}
+	return set
+}
+
+func (list *accessList) empty() bool {
+	return len(list.allow) == 0 && len(list.deny) == 0 &&
+		len(list.allowCountries) == 0 && len(list.denyCountries) == 0 &&
+		len(list.allowASNs) == 0 && len(list.denyASNs) == 0
+}
+
+// allowed reports whether ip may use the route.
+func (list *accessList) allowed(ip string) bool {
+	return len(list.denial(ip)) == 0
+}
+
+// denial says why ip may not use the route, it is empty when the client is
+// allowed. Addresses that cannot be parsed are only let through when there
+// are no rules at all.
+func (list *accessList) denial(ip string) string {
+	if list == nil || list.empty() {
+		return ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Sprintf("client address %q is invalid", ip)
+	}
+	if list.deny.contains(addr) {
+		return "client address is denied"
+	}
+	var geo GeoInfo
+	if len(list.allowCountries) > 0 || len(list.denyCountries) > 0 || len(list.allowASNs) > 0 || len(list.denyASNs) > 0 {
+		geo = list.geo.Lookup(addr.Unmap().String())
+	}
+	if list.denyCountries[geo.Country] {
+		return fmt.Sprintf("country %s is denied", geo.Country)
+	}
+	if list.denyASNs[geo.ASN] {
+		return fmt.Sprintf("asn %d is denied", geo.ASN)
+	}
+	if len(list.allow) == 0 && len(list.allowCountries) == 0 && len(list.allowASNs) == 0 {
+		return ""
+	}
+	if list.allow.contains(addr) || list.allowCountries[geo.Country] || list.allowASNs[geo.ASN] {
+		return ""
+	}
+	return "client is not in the allow list"
+}
+
+type clientIPKey struct{}
+
+// WithClientIP records the address of the client a proxied request came
+// from, as found behind trusted proxies.
+func WithClientIP(r *http.Request, ip string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+// clientIP returns the address recorded by WithClientIP, falling back to
+// the remote address of the connection.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return hostIP(r.RemoteAddr)
+}
+
+// ClientIP finds the client of a request. X-Forwarded-For is only believed
+// when the request comes from a trusted proxy, in which case the right most
+// address that is not a trusted proxy itself is the client.
+func (r *Router) ClientIP(req *http.Request) string {
+	remote := hostIP(req.RemoteAddr)
+	addr, err := netip.ParseAddr(remote)
+	if err != nil || !r.trustedProxies.contains(addr) {
+		return remote
+	}
+	forwarded := []string{}
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	client := remote
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap().String()
+		if !r.trustedProxies.contains(addr) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,61 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"warptail/pkg/utils"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const ACME_CHALLENGE_PATH = "/.well-known/acme-challenge/"
+
+const DEFAULT_ACME_CACHE_DIR = "certs"
+
+// newACMEManager builds the autocert manager used to obtain and renew
+// certificates for http and https routes. Certificates are cached on disk so
+// restarts do not hit the CA again. hostPolicy rejects names that are not
+// routed by warptail.
+func newACMEManager(config utils.ACMEConfig, hostPolicy autocert.HostPolicy) (*autocert.Manager, error) {
+	cacheDir := config.CacheDir
+	if len(cacheDir) == 0 {
+		cacheDir = DEFAULT_ACME_CACHE_DIR
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: hostPolicy,
+		Email:      config.Email,
+	}
+	if len(config.DirectoryURL) == 0 && len(config.CAFile) == 0 {
+		return manager, nil
+	}
+
+	client := &acme.Client{DirectoryURL: config.DirectoryURL}
+	if len(config.CAFile) > 0 {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read acme ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+	manager.Client = client
+	return manager, nil
+}
+
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
@@ -0,0 +1,42 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"warptail/pkg/utils"
+)
+
+// authenticator checks a request of an http route before it is proxied. It
+// returns the user the request was made by, or false after answering the
+// request itself, for example with a 401 or a redirect to a login page.
+type authenticator interface {
+	authenticate(w http.ResponseWriter, r *http.Request) (string, bool)
+}
+
+// newAuthenticator builds the authentication configured for route name, it
+// is nil when the route is open to everyone.
+func newAuthenticator(name string, config utils.AuthConfig) (authenticator, error) {
+	basic := len(config.Basic.Users) > 0 || len(config.Basic.HtpasswdFile) > 0
+	oidc := len(config.OIDC.Issuer) > 0
+	forward := len(config.Forward.Address) > 0
+	token := len(config.JWT.JWKSURL) > 0 || len(config.JWT.KeyFiles) > 0 || len(config.JWT.Secret) > 0 || len(config.APIKeys.Keys) > 0
+	kinds := 0
+	for _, configured := range []bool{basic, oidc, forward, token} {
+		if configured {
+			kinds++
+		}
+	}
+	switch {
+	case kinds > 1:
+		return nil, fmt.Errorf("route %s can only use one of basic, oidc, forward or jwt and api key auth", name)
+	case basic:
+		return newBasicAuth(config.Basic)
+	case oidc:
+		return newOIDCAuth(name, config.OIDC)
+	case forward:
+		return newForwardAuth(config.Forward)
+	case token:
+		return newTokenAuth(config.JWT, config.APIKeys)
+	}
+	return nil, nil
+}
@@ -0,0 +1,260 @@
+package router
+
+import (
+	"crypto/tls"
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+	"warptail/pkg/utils"
+)
+
+var (
+	ErrNoBackends        = errors.New("no backends configured")
+	ErrNoHealthyBackends = errors.New("no healthy backends available")
+	ErrBackendsEjected   = errors.New("all backends are ejected after repeated failures")
+)
+
+// Backend is a single tailnet machine traffic of a route can be sent to.
+type Backend struct {
+	utils.Machine
+	data    *utils.TimeSeries
+	active  atomic.Int64
+	health  backendHealth
+	breaker circuitBreaker
+	tls     atomic.Pointer[tls.Config]
+}
+
+type BackendInfo struct {
+	utils.Machine
+	Healthy      bool
+	LastCheck    time.Time
+	HealthError  string
+	Ejected      bool
+	EjectedUntil time.Time
+	Connections  int64
+	Stats        utils.TimeSeriesData
+}
+
+func NewBackend(machine utils.Machine) *Backend {
+	return &Backend{
+		Machine: machine,
+		data:    utils.NewTimeSeries(time.Second, 1000),
+		health:  backendHealth{healthy: true},
+	}
+}
+
+// dialer wraps dial in TLS when the machine is reached over TLS.
+func (backend *Backend) dialer(dial Dialer) Dialer {
+	if config := backend.tls.Load(); config != nil {
+		return dial.WithTLS(config)
+	}
+	return dial
+}
+
+// Acquire marks a connection or request as in flight on the backend. The
+// returned func releases it again.
+func (backend *Backend) Acquire() func() {
+	backend.active.Add(1)
+	return func() { backend.active.Add(-1) }
+}
+
+func (backend *Backend) Connections() int64 {
+	return backend.active.Load()
+}
+
+// Available reports whether new traffic may be sent to the backend.
+func (backend *Backend) Available() bool {
+	return backend.health.Healthy() && backend.breaker.available()
+}
+
+// Report feeds the outcome of a dial or request into the circuit breaker
+// of the backend.
+func (backend *Backend) Report(err error, config utils.OutlierDetectionConfig) {
+	if err == nil {
+		backend.breaker.success()
+		return
+	}
+	if backend.breaker.failure(config) {
+		until, _ := backend.breaker.ejectedUntil()
+		log.Printf("backend %s ejected until %s: %v", backend.Machine, until.Format(time.RFC3339), err)
+	}
+}
+
+func (backend *Backend) Info() BackendInfo {
+	ejectedUntil, ejected := backend.breaker.ejectedUntil()
+	backend.health.mu.Lock()
+	defer backend.health.mu.Unlock()
+	return BackendInfo{
+		Machine:      backend.Machine,
+		Healthy:      backend.health.healthy,
+		LastCheck:    backend.health.lastCheck,
+		HealthError:  backend.health.lastError,
+		Ejected:      ejected,
+		EjectedUntil: ejectedUntil,
+		Connections:  backend.Connections(),
+		Stats:        backend.data.Snapshot(),
+	}
+}
+
+// BackendPool picks the backend for each connection or request of a route.
+type BackendPool struct {
+	strategy utils.LoadBalancer
+	backends []*Backend
+	counter  atomic.Uint64
+	checker  *healthChecker
+}
+
+// NewBackendPool builds a pool for machines. Backends of the previous pool
+// that are still configured are kept so their stats survive an update.
+func NewBackendPool(strategy utils.LoadBalancer, machines []utils.Machine, previous *BackendPool) *BackendPool {
+	pool := &BackendPool{
+		strategy: strategy,
+		backends: make([]*Backend, 0, len(machines)),
+	}
+	for _, machine := range machines {
+		backend := previous.find(machine)
+		if backend == nil {
+			backend = NewBackend(machine)
+		}
+		pool.backends = append(pool.backends, backend)
+	}
+	return pool
+}
+
+// useTLS hands the backends of the pool their TLS configs from
+// loadBackendTLS.
+func (pool *BackendPool) useTLS(configs map[utils.Machine]*tls.Config) {
+	for _, backend := range pool.backends {
+		backend.tls.Store(configs[backend.Machine])
+	}
+}
+
+func (pool *BackendPool) find(machine utils.Machine) *Backend {
+	if pool == nil {
+		return nil
+	}
+	for _, backend := range pool.backends {
+		if backend.Machine == machine {
+			return backend
+		}
+	}
+	return nil
+}
+
+// Next returns an available backend for a client. clientIP is only used by
+// the consistent hash strategy. Backends in exclude are only picked when no
+// other backend is available.
+func (pool *BackendPool) Next(clientIP string, exclude ...*Backend) (*Backend, error) {
+	if pool == nil || len(pool.backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	healthy := false
+	backends := make([]*Backend, 0, len(pool.backends))
+	excluded := make([]*Backend, 0, len(exclude))
+	for _, backend := range pool.backends {
+		healthy = healthy || backend.health.Healthy()
+		if !backend.Available() {
+			continue
+		}
+		if slices.Contains(exclude, backend) {
+			excluded = append(excluded, backend)
+		} else {
+			backends = append(backends, backend)
+		}
+	}
+	if len(backends) == 0 {
+		backends = excluded
+	}
+	for len(backends) > 0 {
+		backend := pool.pick(backends, clientIP)
+		if backend.breaker.allow() {
+			return backend, nil
+		}
+		// someone else claimed the half-open probe of this backend
+		for i := range backends {
+			if backends[i] == backend {
+				backends = append(backends[:i], backends[i+1:]...)
+				break
+			}
+		}
+	}
+	if !healthy {
+		return nil, ErrNoHealthyBackends
+	}
+	return nil, ErrBackendsEjected
+}
+
+func (pool *BackendPool) pick(backends []*Backend, clientIP string) *Backend {
+	switch pool.strategy {
+	case utils.LeastConnections:
+		best := backends[0]
+		for _, backend := range backends[1:] {
+			if backend.Connections() < best.Connections() {
+				best = backend
+			}
+		}
+		return best
+	case utils.Random:
+		return backends[rand.Intn(len(backends))]
+	case utils.ConsistentHash:
+		return rendezvous(backends, clientIP)
+	default:
+		n := pool.counter.Add(1) - 1
+		return backends[n%uint64(len(backends))]
+	}
+}
+
+// rendezvous picks the backend with the highest hash for the key so a
+// client keeps hitting the same backend and only the clients of a removed
+// backend move when the pool changes.
+func rendezvous(backends []*Backend, key string) *Backend {
+	var best *Backend
+	var bestScore uint64
+	for _, backend := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(backend.Machine.String()))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = backend, score
+		}
+	}
+	return best
+}
+
+// Healthy reports whether at least one backend of the pool is healthy.
+func (pool *BackendPool) Healthy() bool {
+	if pool == nil {
+		return false
+	}
+	for _, backend := range pool.backends {
+		if backend.health.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+func (pool *BackendPool) Info() []BackendInfo {
+	if pool == nil {
+		return []BackendInfo{}
+	}
+	info := make([]BackendInfo, 0, len(pool.backends))
+	for _, backend := range pool.backends {
+		info = append(info, backend.Info())
+	}
+	return info
+}
+
+// hostIP strips the port from a remote address.
+func hostIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,67 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"warptail/pkg/utils"
+)
+
+// loadBackendTLS builds the TLS configs of the machines of a route that are
+// reached over TLS, checking that their schemes suit the route type.
+func loadBackendTLS(routeType utils.RouteType, machines []utils.Machine) (map[utils.Machine]*tls.Config, error) {
+	plain, secure := string(routeType), ""
+	switch routeType {
+	case utils.HTTP, utils.HTTPS:
+		plain, secure = "http", "https"
+	case utils.TCP:
+		secure = "tls"
+	}
+	configs := make(map[utils.Machine]*tls.Config)
+	for _, machine := range machines {
+		switch machine.Scheme {
+		case "", plain:
+			continue
+		case secure:
+		default:
+			return nil, fmt.Errorf("scheme %s of %s is not supported by %s routes", machine.Scheme, machine, routeType)
+		}
+		config, err := newBackendTLS(machine)
+		if err != nil {
+			return nil, fmt.Errorf("tls config of %s: %v", machine, err)
+		}
+		configs[machine] = config
+	}
+	return configs, nil
+}
+
+func newBackendTLS(machine utils.Machine) (*tls.Config, error) {
+	options := machine.TLS
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+	if len(config.ServerName) == 0 {
+		config.ServerName = machine.Address
+	}
+	if len(options.CAFile) > 0 {
+		data, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s holds no certificates", options.CAFile)
+		}
+	}
+	if len(options.CertFile) > 0 || len(options.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,115 @@
+package router
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"warptail/pkg/utils"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const DEFAULT_AUTH_REALM = "warptail"
+
+// basicAuth checks usernames and passwords against bcrypt hashes. As
+// browsers send the password with every request the last password that
+// matched is remembered per user, so bcrypt only runs when it changes.
+type basicAuth struct {
+	realm    string
+	users    map[string][]byte
+	mu       sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+func newBasicAuth(config utils.BasicAuthConfig) (*basicAuth, error) {
+	auth := &basicAuth{
+		realm:    config.Realm,
+		users:    make(map[string][]byte),
+		verified: make(map[string][sha256.Size]byte),
+	}
+	if len(auth.realm) == 0 {
+		auth.realm = DEFAULT_AUTH_REALM
+	}
+	if len(config.HtpasswdFile) > 0 {
+		if err := auth.loadHtpasswd(config.HtpasswdFile); err != nil {
+			return nil, err
+		}
+	}
+	for user, hash := range config.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("password of %s is not a bcrypt hash: %v", user, err)
+		}
+		auth.users[user] = []byte(hash)
+	}
+	return auth, nil
+}
+
+// loadHtpasswd reads user:hash lines, only bcrypt hashes are supported.
+func (auth *basicAuth) loadHtpasswd(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open htpasswd file: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("%s:%d: %s does not use bcrypt, create it with htpasswd -B", path, line, user)
+		}
+		auth.users[user] = []byte(hash)
+	}
+	return scanner.Err()
+}
+
+func (auth *basicAuth) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok || !auth.verify(user, password) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", auth.realm))
+		errorPage(w, http.StatusUnauthorized, "Sign in to continue.")
+		return "", false
+	}
+	// the credentials are for warptail, not the backend
+	r.Header.Del("Authorization")
+	return user, true
+}
+
+func (auth *basicAuth) verify(user, password string) bool {
+	hash, ok := auth.users[user]
+	if !ok {
+		// spend the same time as for a known user
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	sum := sha256.Sum256([]byte(password))
+	auth.mu.Lock()
+	known, cached := auth.verified[user]
+	auth.mu.Unlock()
+	if cached && subtle.ConstantTimeCompare(known[:], sum[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	auth.mu.Lock()
+	auth.verified[user] = sum
+	auth.mu.Unlock()
+	return true
+}
+
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("warptail"), bcrypt.DefaultCost)
+	return hash
+})
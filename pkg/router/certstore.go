@@ -0,0 +1,76 @@
+package router
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// CertStore holds the certificates served by the TLS listener keyed by the
+// server name they were loaded for.
+type CertStore struct {
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+func NewCertStore() *CertStore {
+	return &CertStore{
+		certs: make(map[string]*tls.Certificate),
+	}
+}
+
+// Load reads a PEM encoded certificate and key pair from disk and serves it
+// for name, replacing any certificate already stored for it.
+func (store *CertStore) Load(name, certFile, keyFile string) error {
+	cert, err := loadCertificate(name, certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	store.Set(name, cert)
+	return nil
+}
+
+func loadCertificate(name, certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load certificate for %s: %v", name, err)
+	}
+	return &cert, nil
+}
+
+func (store *CertStore) Set(name string, cert *tls.Certificate) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.certs[strings.ToLower(name)] = cert
+}
+
+func (store *CertStore) Remove(name string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.certs, strings.ToLower(name))
+}
+
+// Lookup finds the certificate for a server name, falling back to a
+// wildcard certificate for the parent domain.
+func (store *CertStore) Lookup(name string) (*tls.Certificate, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if cert, ok := store.certs[name]; ok {
+		return cert, true
+	}
+	if i := strings.Index(name, "."); i != -1 {
+		if cert, ok := store.certs["*"+name[i:]]; ok {
+			return cert, true
+		}
+	}
+	return nil, false
+}
+
+func (store *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert, ok := store.Lookup(hello.ServerName); ok {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
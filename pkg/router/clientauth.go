@@ -0,0 +1,220 @@
+package router
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"warptail/pkg/utils"
+)
+
+const (
+	CLIENT_CERT_SUBJECT_HEADER     = "X-Client-Cert-Subject"
+	CLIENT_CERT_ISSUER_HEADER      = "X-Client-Cert-Issuer"
+	CLIENT_CERT_FINGERPRINT_HEADER = "X-Client-Cert-Fingerprint"
+)
+
+// crlCheckInterval is how often the crl file is checked for changes.
+const crlCheckInterval = 10 * time.Second
+
+var (
+	ErrClientCertRequired = errors.New("client certificate required")
+	ErrClientCertRevoked  = errors.New("client certificate revoked")
+	ErrCRLExpired         = errors.New("client certificate revocation list is out of date")
+)
+
+// clientVerifier checks the client certificates of an https route against
+// its CA bundle and CRL. crypto/tls only requests the certificate, checking
+// it here lets every route trust different CAs on the shared listener.
+type clientVerifier struct {
+	mode    utils.ClientAuthMode
+	roots   *x509.CertPool
+	cas     []*x509.Certificate
+	crlFile string
+
+	mu          sync.Mutex
+	revoked     map[string]bool
+	crlModified time.Time
+	crlChecked  time.Time
+	// crlNextUpdate is when the issuer publishes the next crl, zero when
+	// the crl does not say
+	crlNextUpdate time.Time
+	crlExpired    bool
+}
+
+// newClientVerifier is nil when the route does not ask for certificates.
+func newClientVerifier(config utils.ClientAuthConfig) (*clientVerifier, error) {
+	if len(config.CAFile) == 0 {
+		return nil, nil
+	}
+	verifier := &clientVerifier{mode: config.Mode, roots: x509.NewCertPool(), crlFile: config.CRLFile}
+	switch verifier.mode {
+	case "":
+		verifier.mode = utils.ClientAuthRequire
+	case utils.ClientAuthRequire, utils.ClientAuthOptional:
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %s", config.Mode)
+	}
+	data, err := os.ReadFile(config.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client ca file: %v", err)
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", config.CAFile, err)
+		}
+		verifier.cas = append(verifier.cas, ca)
+		verifier.roots.AddCert(ca)
+	}
+	if len(verifier.cas) == 0 {
+		return nil, fmt.Errorf("%s holds no certificates", config.CAFile)
+	}
+	if len(verifier.crlFile) > 0 {
+		if err := verifier.loadCRL(); err != nil {
+			return nil, err
+		}
+	}
+	return verifier, nil
+}
+
+// verify checks the certificates a client presented, leaf first.
+func (verifier *clientVerifier) verify(certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		if verifier.mode == utils.ClientAuthOptional {
+			return nil
+		}
+		return ErrClientCertRequired
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         verifier.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return err
+	}
+	return verifier.checkRevocation(certs[0])
+}
+
+// checkRevocation looks cert up in the crl, which is reloaded when the file
+// changed. Once the crl is past its next update clients are refused in
+// require mode, optional mode only logs it.
+func (verifier *clientVerifier) checkRevocation(cert *x509.Certificate) error {
+	if len(verifier.crlFile) == 0 {
+		return nil
+	}
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+	if time.Since(verifier.crlChecked) >= crlCheckInterval {
+		verifier.crlChecked = time.Now()
+		if info, err := os.Stat(verifier.crlFile); err == nil && !info.ModTime().Equal(verifier.crlModified) {
+			// a broken update keeps the list we have
+			if err := verifier.loadCRL(); err != nil {
+				log.Printf("reloading crl %s failed: %v", verifier.crlFile, err)
+			}
+		}
+	}
+	if verifier.revoked[revocationKey(cert.RawIssuer, cert.SerialNumber.String())] {
+		return ErrClientCertRevoked
+	}
+	if verifier.crlNextUpdate.IsZero() || time.Now().Before(verifier.crlNextUpdate) {
+		return nil
+	}
+	if !verifier.crlExpired {
+		verifier.crlExpired = true
+		log.Printf("crl %s is out of date since %s, update it", verifier.crlFile, verifier.crlNextUpdate.Format(time.RFC3339))
+	}
+	if verifier.mode == utils.ClientAuthRequire {
+		return ErrCRLExpired
+	}
+	return nil
+}
+
+// loadCRL reads the revoked serials of every CRL in crlFile, it must be
+// called with mu held or before the verifier is used.
+func (verifier *clientVerifier) loadCRL() error {
+	info, err := os.Stat(verifier.crlFile)
+	if err != nil {
+		return fmt.Errorf("unable to read crl: %v", err)
+	}
+	data, err := os.ReadFile(verifier.crlFile)
+	if err != nil {
+		return fmt.Errorf("unable to read crl: %v", err)
+	}
+	ders := [][]byte{}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+	revoked := make(map[string]bool)
+	var nextUpdate time.Time
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("%s: %v", verifier.crlFile, err)
+		}
+		if !verifier.signedByCA(crl) {
+			return fmt.Errorf("%s is not signed by a client ca", verifier.crlFile)
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[revocationKey(crl.RawIssuer, entry.SerialNumber.String())] = true
+		}
+		if !crl.NextUpdate.IsZero() && (nextUpdate.IsZero() || crl.NextUpdate.Before(nextUpdate)) {
+			nextUpdate = crl.NextUpdate
+		}
+	}
+	verifier.revoked = revoked
+	verifier.crlModified = info.ModTime()
+	verifier.crlChecked = time.Now()
+	verifier.crlNextUpdate = nextUpdate
+	verifier.crlExpired = false
+	return nil
+}
+
+func (verifier *clientVerifier) signedByCA(crl *x509.RevocationList) bool {
+	for _, ca := range verifier.cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func revocationKey(issuer []byte, serial string) string {
+	return string(issuer) + "/" + serial
+}
+
+// forward passes the verified certificate to the backend. Headers sent by
+// the client are always dropped so the backend can trust them.
+func (verifier *clientVerifier) forward(r *http.Request) {
+	for _, header := range []string{CLIENT_CERT_SUBJECT_HEADER, CLIENT_CERT_ISSUER_HEADER, CLIENT_CERT_FINGERPRINT_HEADER} {
+		r.Header.Del(header)
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return
+	}
+	cert := r.TLS.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	r.Header.Set(CLIENT_CERT_SUBJECT_HEADER, cert.Subject.String())
+	r.Header.Set(CLIENT_CERT_ISSUER_HEADER, cert.Issuer.String())
+	r.Header.Set(CLIENT_CERT_FINGERPRINT_HEADER, hex.EncodeToString(fingerprint[:]))
+}
@@ -0,0 +1,105 @@
+package router
+
+import (
+	"sync"
+	"sync/atomic"
+	"warptail/pkg/utils"
+)
+
+// RouteCounters are totals of notable events on a route since it was
+// created. Requests counts connections for tcp routes and client sessions
+// for udp routes. Active is the number of connections, sessions or in
+// flight requests right now and Rejected how many were turned away by the
+// connection or rate limits. Denied counts clients refused by the access
+// lists of the route and CertRejected clients of an https route without a
+// valid client certificate. Countries breaks the traffic down by the country of
+// the clients when a GeoIP database is configured.
+type RouteCounters struct {
+	Requests     uint64
+	Retries      uint64
+	Active       int64
+	Rejected     uint64
+	Denied       uint64
+	CertRejected uint64
+	Countries    map[string]CountryStats
+}
+
+// CountryStats counts the requests or connections of clients from a single
+// country and the bytes sent to and received from them.
+type CountryStats struct {
+	Requests uint64
+	Sent     uint64
+	Received uint64
+}
+
+type routeCounters struct {
+	requests atomic.Uint64
+	retries  atomic.Uint64
+	rejected atomic.Uint64
+	denied   atomic.Uint64
+	// certRejected counts failed handshakes as well as requests
+	certRejected atomic.Uint64
+	limiter      connLimiter
+
+	mu        sync.Mutex
+	countries map[string]CountryStats
+}
+
+func (counters *routeCounters) Snapshot() RouteCounters {
+	return RouteCounters{
+		Requests:     counters.requests.Load(),
+		Retries:      counters.retries.Load(),
+		Active:       counters.limiter.active(),
+		Rejected:     counters.rejected.Load(),
+		Denied:       counters.denied.Load(),
+		CertRejected: counters.certRejected.Load(),
+		Countries:    counters.countrySnapshot(),
+	}
+}
+
+func (counters *routeCounters) countrySnapshot() map[string]CountryStats {
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+	countries := make(map[string]CountryStats, len(counters.countries))
+	for country, stats := range counters.countries {
+		countries[country] = stats
+	}
+	return countries
+}
+
+// record adds a finished request, connection or session to the stats of
+// the client's country.
+func (counters *routeCounters) record(entry utils.AccessLogEntry) {
+	if len(entry.Country) == 0 || entry.Event == utils.OpenEvent {
+		return
+	}
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+	if counters.countries == nil {
+		counters.countries = make(map[string]CountryStats)
+	}
+	stats := counters.countries[entry.Country]
+	stats.Requests++
+	stats.Sent += entry.BytesSent
+	stats.Received += entry.BytesReceived
+	counters.countries[entry.Country] = stats
+}
+
+// acquire claims a connection of ip within limits, counting it as rejected
+// when it is over them.
+func (counters *routeCounters) acquire(ip string, limits utils.ConnectionLimits) (func(), error) {
+	release, err := counters.limiter.acquire(ip, limits)
+	if err != nil {
+		counters.rejected.Add(1)
+	}
+	return release, err
+}
+
+// allowed checks ip against an access list, counting it when denied.
+func (counters *routeCounters) allowed(access *accessList, ip string) bool {
+	if access.allowed(ip) {
+		return true
+	}
+	counters.denied.Add(1)
+	return false
+}
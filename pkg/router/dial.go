@@ -0,0 +1,55 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"tailscale.com/client/tailscale"
+)
+
+// Dialer opens a connection to an address on the tailnet.
+type Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+func localClientDialer(client *tailscale.LocalClient) Dialer {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		return client.UserDial(ctx, network, host, uint16(p))
+	}
+}
+
+// WithTimeout bounds every dial so an unreachable tailnet machine fails
+// instead of hanging.
+func (dial Dialer) WithTimeout(timeout time.Duration) Dialer {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, network, address)
+	}
+}
+
+// WithTLS runs a TLS handshake with config over every connection.
+func (dial Dialer) WithTLS(config *tls.Config) Dialer {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake with %s failed: %v", address, err)
+		}
+		return tlsConn, nil
+	}
+}
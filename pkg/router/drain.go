@@ -0,0 +1,45 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const DEFAULT_DRAIN_TIMEOUT = 30 * time.Second
+
+var errRouteStopped = errors.New("route stopped before the request finished")
+
+// drainer tracks the connections or requests of a single run of a route so
+// stopping the route can let them finish. ctx is cancelled once they should
+// be closed regardless.
+type drainer struct {
+	active sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newDrainer() *drainer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &drainer{ctx: ctx, cancel: cancel}
+}
+
+// drain waits up to timeout for the tracked work to finish, then cancels
+// ctx to close whatever is left and waits for that as well. No new work
+// may be added once drain is called.
+func (d *drainer) drain(timeout time.Duration) {
+	done := make(chan bool)
+	go func() {
+		d.active.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+	d.cancel()
+	<-done
+}
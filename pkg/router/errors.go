@@ -0,0 +1,27 @@
+package router
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+)
+
+const errorPageTemplate = `<!DOCTYPE html>
+<html>
+<head><title>%[1]d %[2]s</title></head>
+<body style="font-family: sans-serif; text-align: center; padding-top: 10%%">
+<h1>%[1]d %[2]s</h1>
+<p>%[3]s</p>
+<hr><small>warptail</small>
+</body>
+</html>
+`
+
+// errorPage answers a proxied request that could not be forwarded with a
+// short html page explaining why.
+func errorPage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, errorPageTemplate, status, http.StatusText(status), html.EscapeString(message))
+}
@@ -0,0 +1,142 @@
+package router
+
+import (
+	"sync"
+	"time"
+	"warptail/pkg/utils"
+)
+
+type EventType string
+
+const (
+	RouteAddedEvent    = EventType("route_added")
+	RouteUpdatedEvent  = EventType("route_updated")
+	RouteDeletedEvent  = EventType("route_deleted")
+	RouteStatusEvent   = EventType("route_status")
+	BackendHealthEvent = EventType("backend_health")
+	TrafficEvent       = EventType("traffic")
+)
+
+// DEFAULT_EVENT_BUFFER is how many events a subscriber may fall behind
+// before further events are dropped for it.
+const DEFAULT_EVENT_BUFFER = 256
+
+// Event is published on the router's EventBus. Only the fields relevant to
+// the event type are set: Config for added and updated routes, Status for
+// status changes, Backend, Healthy and Error for health changes and Traffic
+// for the per second traffic of a route.
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Route   string
+	Name    string
+	Config  *utils.RouteConfig
+	Status  RouterStatus
+	Backend string
+	Healthy bool
+	Error   string
+	Traffic *utils.ProxyStats
+}
+
+// EventBus fans events out to subscribers. Publishing never blocks, a
+// subscriber that does not keep up misses events instead.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Subscribe returns a channel receiving every event published from now on
+// and a func to unsubscribe, which closes the channel.
+func (bus *EventBus) Subscribe() (<-chan Event, func()) {
+	events := make(chan Event, DEFAULT_EVENT_BUFFER)
+	bus.mu.Lock()
+	bus.subscribers[events] = struct{}{}
+	bus.mu.Unlock()
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			bus.mu.Lock()
+			delete(bus.subscribers, events)
+			bus.mu.Unlock()
+			close(events)
+		})
+	}
+}
+
+// Publish sends event to every subscriber. Routes built without a bus
+// publish nothing.
+func (bus *EventBus) Publish(event Event) {
+	if bus == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for subscriber := range bus.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+func (bus *EventBus) subscribed() bool {
+	if bus == nil {
+		return false
+	}
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return len(bus.subscribers) > 0
+}
+
+// routeStatus publishes the new status of the route of config, routes call
+// it whenever their status changes.
+func (bus *EventBus) routeStatus(config utils.RouteConfig, status RouterStatus) {
+	bus.Publish(Event{Type: RouteStatusEvent, Route: config.Id, Name: config.Name, Status: status})
+}
+
+// healthChanges returns the func the health checks of the route of config
+// report a backend turning healthy or unhealthy with.
+func (bus *EventBus) healthChanges(config utils.RouteConfig) func(*Backend, error) {
+	return func(backend *Backend, err error) {
+		event := Event{Type: BackendHealthEvent, Route: config.Id, Name: config.Name, Backend: backend.Machine.String(), Healthy: err == nil}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		bus.Publish(event)
+	}
+}
+
+// monitorEvents publishes the traffic of the running routes in the previous
+// second, once a second until quit is closed. Status and health changes are
+// published by the routes as they happen.
+func (r *Router) monitorEvents(quit chan bool) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			if !r.events.subscribed() {
+				continue
+			}
+			for _, route := range r.list() {
+				if route.Status() != RUNNING {
+					continue
+				}
+				config := route.Config()
+				traffic := route.Traffic(now.Add(-time.Second))
+				r.events.Publish(Event{Type: TrafficEvent, Route: config.Id, Name: config.Name, Traffic: &traffic})
+			}
+		}
+	}
+}
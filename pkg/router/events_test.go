@@ -0,0 +1,78 @@
+package router
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"warptail/pkg/utils"
+)
+
+// nextEvent waits for the next event of type kind, skipping the others.
+func nextEvent(t *testing.T, events <-chan Event, kind EventType) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == kind {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", kind)
+		}
+	}
+}
+
+// TestStatusEvents checks every status change is published, however fast
+// the route goes through them.
+func TestStatusEvents(t *testing.T) {
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	route := NewHTTPRoute(utils.RouteConfig{Id: "1", Name: "app.test", Type: utils.HTTP}, nil, nil, bus)
+	if err := route.Start(); err != nil {
+		t.Fatal(err)
+	}
+	route.Stop()
+	if err := route.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer route.Stop()
+	for _, status := range []RouterStatus{RUNNING, STOPPING, STOPPED, RUNNING} {
+		if event := nextEvent(t, events, RouteStatusEvent); event.Status != status || event.Route != "1" {
+			t.Fatalf("got %s of route %s, want %s", event.Status, event.Route, status)
+		}
+	}
+}
+
+func TestHealthEvents(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	machine := testMachine(t, backend)
+	backend.Close()
+
+	bus := NewEventBus()
+	events, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	route := NewHTTPRoute(utils.RouteConfig{
+		Id:      "1",
+		Name:    "app.test",
+		Type:    utils.HTTP,
+		Machine: machine,
+		HealthCheck: utils.HealthCheckConfig{
+			Type:               utils.TCPHealthCheck,
+			Interval:           10 * time.Millisecond,
+			UnhealthyThreshold: 1,
+		},
+	}, nil, nil, bus)
+	route.dial = (&net.Dialer{}).DialContext
+	if err := route.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer route.Stop()
+	event := nextEvent(t, events, BackendHealthEvent)
+	if event.Healthy || event.Backend != machine.String() || len(event.Error) == 0 {
+		t.Errorf("got %+v", event)
+	}
+}
@@ -0,0 +1,132 @@
+package router
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+	"warptail/pkg/utils"
+)
+
+const (
+	DEFAULT_FORWARD_AUTH_TIMEOUT = 10 * time.Second
+	DEFAULT_USER_HEADER          = "Remote-User"
+)
+
+// forwardAuthHeaders describe the original request to the auth server.
+// Values sent by the client are replaced so they cannot be spoofed.
+var forwardAuthHeaders = []string{
+	"X-Forwarded-Method",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Forwarded-Uri",
+	"X-Forwarded-For",
+}
+
+// hopHeaders belong to a single connection and are not passed on.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardAuth lets an external auth server decide about every request.
+type forwardAuth struct {
+	address    string
+	headers    []string
+	userHeader string
+	client     *http.Client
+}
+
+func newForwardAuth(config utils.ForwardAuthConfig) (*forwardAuth, error) {
+	address, err := url.Parse(config.Address)
+	if err != nil || (address.Scheme != "http" && address.Scheme != "https") || len(address.Host) == 0 {
+		return nil, fmt.Errorf("forward auth address %q is not a url", config.Address)
+	}
+	auth := &forwardAuth{
+		address:    config.Address,
+		userHeader: config.UserHeader,
+		client: &http.Client{
+			Timeout: duration(config.Timeout, DEFAULT_FORWARD_AUTH_TIMEOUT),
+			// redirects are meant for the visitor, not for us
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	for _, header := range config.ResponseHeaders {
+		auth.headers = append(auth.headers, http.CanonicalHeaderKey(header))
+	}
+	if len(auth.userHeader) == 0 {
+		auth.userHeader = DEFAULT_USER_HEADER
+	}
+	return auth, nil
+}
+
+func (auth *forwardAuth) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, auth.address, nil)
+	if err != nil {
+		errorPage(w, http.StatusInternalServerError, err.Error())
+		return "", false
+	}
+	req.Header = r.Header.Clone()
+	for _, header := range hopHeaders {
+		req.Header.Del(header)
+	}
+	req.Header.Del("Content-Length")
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", clientIP(r))
+
+	resp, err := auth.client.Do(req)
+	if err != nil {
+		log.Printf("forward auth to %s failed: %v", auth.address, err)
+		errorPage(w, http.StatusBadGateway, "The sign in service could not be reached.")
+		return "", false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// the auth server's answer, usually a redirect to its login page or
+		// a 401, goes to the visitor unchanged
+		for header, values := range resp.Header {
+			w.Header()[header] = values
+		}
+		for _, header := range hopHeaders {
+			w.Header().Del(header)
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return "", false
+	}
+	// only the auth server may set these, values sent by the client are
+	// dropped even when the answer does not have them
+	r.Header.Del(auth.userHeader)
+	for _, header := range auth.headers {
+		r.Header.Del(header)
+	}
+	for _, header := range auth.headers {
+		if values := resp.Header.Values(header); len(values) > 0 {
+			r.Header[header] = values
+		}
+	}
+	user := resp.Header.Get(auth.userHeader)
+	if len(user) > 0 {
+		r.Header.Set(auth.userHeader, user)
+	}
+	return user, true
+}
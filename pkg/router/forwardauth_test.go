@@ -0,0 +1,129 @@
+package router
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"warptail/pkg/utils"
+)
+
+// newForwardAuthServer answers like Authelia: a session cookie lets the
+// request through with the user in Remote-User, anything else is sent to
+// the login page, and the logout path answers 401.
+func newForwardAuthServer(t *testing.T, seen *http.Header) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*seen = r.Header.Clone()
+		switch {
+		case r.Header.Get("X-Forwarded-Uri") == "/logout":
+			w.Header().Set("WWW-Authenticate", `Basic realm="auth"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, "signed out")
+		case r.Header.Get("Cookie") == "session=valid":
+			w.Header().Set("Remote-User", "ada")
+			w.Header().Add("Remote-Groups", "admins")
+			w.Header().Add("Remote-Groups", "users")
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.Redirect(w, r, "https://auth.test/login", http.StatusFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestForwardAuth(t *testing.T) {
+	var seen http.Header
+	server := newForwardAuthServer(t, &seen)
+	auth, err := newForwardAuth(utils.ForwardAuthConfig{
+		Address:         server.URL,
+		ResponseHeaders: []string{"remote-groups", "Remote-Email"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "http://app.test/private?page=1", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("Cookie", "session=valid")
+		r.Header.Set("X-Forwarded-Uri", "/spoofed")
+		w := httptest.NewRecorder()
+		user, ok := auth.authenticate(w, r)
+		if !ok || user != "ada" {
+			t.Fatalf("request was not let through, user %q", user)
+		}
+		if seen.Get("X-Forwarded-Method") != http.MethodPost || seen.Get("X-Forwarded-Proto") != "http" ||
+			seen.Get("X-Forwarded-Host") != "app.test" || seen.Get("X-Forwarded-Uri") != "/private?page=1" ||
+			seen.Get("X-Forwarded-For") != "192.0.2.1" {
+			t.Errorf("auth server got %v", seen)
+		}
+		if got := r.Header.Values("Remote-Groups"); len(got) != 2 || got[0] != "admins" || got[1] != "users" {
+			t.Errorf("Remote-Groups is %v", got)
+		}
+		if r.Header.Get("Remote-User") != "ada" {
+			t.Errorf("Remote-User is %q", r.Header.Get("Remote-User"))
+		}
+		if w.Code != http.StatusOK || w.Body.Len() > 0 {
+			t.Errorf("allowed request got a response %d", w.Code)
+		}
+	})
+
+	t.Run("spoofed headers", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+		r.Header.Set("Cookie", "session=valid")
+		r.Header.Set("Remote-Groups", "root")
+		r.Header.Set("Remote-Email", "root@example.com")
+		r.Header.Set("Remote-User", "root")
+		if _, ok := auth.authenticate(httptest.NewRecorder(), r); !ok {
+			t.Fatalf("request was not let through")
+		}
+		if got := r.Header.Values("Remote-Groups"); len(got) != 2 || got[0] != "admins" {
+			t.Errorf("client Remote-Groups reached the backend: %v", got)
+		}
+		if got := r.Header.Get("Remote-Email"); len(got) > 0 {
+			t.Errorf("client Remote-Email reached the backend: %q", got)
+		}
+		if got := r.Header.Values("Remote-User"); len(got) != 1 || got[0] != "ada" {
+			t.Errorf("client Remote-User reached the backend: %v", got)
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+		w := httptest.NewRecorder()
+		if _, ok := auth.authenticate(w, r); ok {
+			t.Fatalf("request without a session was let through")
+		}
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "https://auth.test/login" {
+			t.Errorf("visitor got %d to %s", w.Code, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://app.test/logout", nil)
+		r.Header.Set("Cookie", "session=valid")
+		w := httptest.NewRecorder()
+		if _, ok := auth.authenticate(w, r); ok {
+			t.Fatalf("request was let through")
+		}
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Basic realm="auth"` || w.Body.String() != "signed out" {
+			t.Errorf("visitor got %d %v %q", w.Code, w.Header(), w.Body.String())
+		}
+	})
+}
+
+func TestForwardAuthUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	auth, err := newForwardAuth(utils.ForwardAuthConfig{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://app.test/", nil)
+	w := httptest.NewRecorder()
+	if _, ok := auth.authenticate(w, r); ok || w.Code != http.StatusBadGateway {
+		t.Errorf("unreachable auth server got %d", w.Code)
+	}
+}
@@ -0,0 +1,101 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"warptail/pkg/utils"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoInfo is what the GeoIP databases know about a client address.
+type GeoInfo struct {
+	Country      string
+	ASN          uint
+	Organization string
+}
+
+// GeoIP looks up clients in MaxMind format databases. A nil GeoIP knows
+// nothing about any address.
+type GeoIP struct {
+	countries *maxminddb.Reader
+	asns      *maxminddb.Reader
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+type asnRecord struct {
+	ASN          uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// NewGeoIP opens the configured databases, it returns nil when none are.
+func NewGeoIP(config utils.GeoIPConfig) (*GeoIP, error) {
+	if len(config.CountryDatabase) == 0 && len(config.ASNDatabase) == 0 {
+		return nil, nil
+	}
+	geo := &GeoIP{}
+	var err error
+	if len(config.CountryDatabase) > 0 {
+		if geo.countries, err = maxminddb.Open(config.CountryDatabase); err != nil {
+			return nil, fmt.Errorf("unable to open country database: %v", err)
+		}
+	}
+	if len(config.ASNDatabase) > 0 {
+		if geo.asns, err = maxminddb.Open(config.ASNDatabase); err != nil {
+			geo.Close()
+			return nil, fmt.Errorf("unable to open asn database: %v", err)
+		}
+	}
+	return geo, nil
+}
+
+func (geo *GeoIP) Lookup(ip string) GeoInfo {
+	info := GeoInfo{}
+	addr := net.ParseIP(ip)
+	if geo == nil || addr == nil {
+		return info
+	}
+	if geo.countries != nil {
+		var record countryRecord
+		if err := geo.countries.Lookup(addr, &record); err == nil {
+			info.Country = record.Country.ISOCode
+			if len(info.Country) == 0 {
+				info.Country = record.RegisteredCountry.ISOCode
+			}
+		}
+	}
+	if geo.asns != nil {
+		var record asnRecord
+		if err := geo.asns.Lookup(addr, &record); err == nil {
+			info.ASN, info.Organization = record.ASN, record.Organization
+		}
+	}
+	return info
+}
+
+func (geo *GeoIP) Country(ip string) string {
+	if geo == nil || geo.countries == nil {
+		return ""
+	}
+	return geo.Lookup(ip).Country
+}
+
+func (geo *GeoIP) Close() {
+	if geo == nil {
+		return
+	}
+	if geo.countries != nil {
+		geo.countries.Close()
+	}
+	if geo.asns != nil {
+		geo.asns.Close()
+	}
+}
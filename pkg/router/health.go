@@ -0,0 +1,230 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"warptail/pkg/utils"
+)
+
+const (
+	DEFAULT_HEALTH_INTERVAL  = 10 * time.Second
+	DEFAULT_HEALTH_TIMEOUT   = 2 * time.Second
+	DEFAULT_HEALTHY_COUNT    = 2
+	DEFAULT_UNHEALTHY_COUNT  = 3
+	healthCheckMaxBodyLength = 64 * 1024
+)
+
+type backendHealth struct {
+	mu        sync.Mutex
+	healthy   bool
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+// record applies the result of a check, returning true when the backend
+// changed between healthy and unhealthy.
+func (health *backendHealth) record(err error, config utils.HealthCheckConfig) bool {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.lastCheck = time.Now()
+	if err != nil {
+		health.lastError = err.Error()
+		health.successes = 0
+		health.failures++
+		if health.healthy && health.failures >= threshold(config.UnhealthyThreshold, DEFAULT_UNHEALTHY_COUNT) {
+			health.healthy = false
+			return true
+		}
+		return false
+	}
+	health.lastError = ""
+	health.failures = 0
+	health.successes++
+	if !health.healthy && health.successes >= threshold(config.HealthyThreshold, DEFAULT_HEALTHY_COUNT) {
+		health.healthy = true
+		return true
+	}
+	return false
+}
+
+// reset marks the backend healthy, returning true when it was not.
+func (health *backendHealth) reset() bool {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	changed := !health.healthy
+	health.healthy = true
+	health.successes = 0
+	health.failures = 0
+	health.lastError = ""
+	return changed
+}
+
+func (health *backendHealth) Healthy() bool {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	return health.healthy
+}
+
+func threshold(value, fallback int) int {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+func duration(value, fallback time.Duration) time.Duration {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// healthChecker probes the backends of a pool on an interval until stopped.
+type healthChecker struct {
+	config  utils.HealthCheckConfig
+	dial    Dialer
+	changed func(*Backend, error)
+	quit    chan bool
+	wg      sync.WaitGroup
+}
+
+// StartHealthChecks probes every backend of the pool in the background,
+// changed is called when a backend turns healthy or unhealthy. Without a
+// health check type every backend is considered healthy.
+func (pool *BackendPool) StartHealthChecks(config utils.HealthCheckConfig, dial Dialer, changed func(*Backend, error)) {
+	pool.StopHealthChecks()
+	if len(config.Type) == 0 {
+		for _, backend := range pool.backends {
+			if backend.health.reset() {
+				changed(backend, nil)
+			}
+		}
+		return
+	}
+	checker := &healthChecker{
+		config:  config,
+		dial:    dial,
+		changed: changed,
+		quit:    make(chan bool),
+	}
+	for _, backend := range pool.backends {
+		checker.wg.Add(1)
+		go checker.run(backend)
+	}
+	pool.checker = checker
+}
+
+func (pool *BackendPool) StopHealthChecks() {
+	if pool == nil || pool.checker == nil {
+		return
+	}
+	close(pool.checker.quit)
+	pool.checker.wg.Wait()
+	pool.checker = nil
+}
+
+func (checker *healthChecker) run(backend *Backend) {
+	defer checker.wg.Done()
+	ticker := time.NewTicker(duration(checker.config.Interval, DEFAULT_HEALTH_INTERVAL))
+	defer ticker.Stop()
+	for {
+		checker.probe(backend)
+		select {
+		case <-checker.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (checker *healthChecker) probe(backend *Backend) {
+	ctx, cancel := context.WithTimeout(context.Background(), duration(checker.config.Timeout, DEFAULT_HEALTH_TIMEOUT))
+	defer cancel()
+	address := backend.Machine.String()
+	if checker.config.Port != 0 {
+		address = net.JoinHostPort(backend.Address, strconv.Itoa(int(checker.config.Port)))
+	}
+
+	dial := backend.dialer(checker.dial)
+	var err error
+	switch checker.config.Type {
+	case utils.HTTPHealthCheck:
+		err = checker.checkHTTP(ctx, dial, backend.Secure(), address)
+	default:
+		err = checker.checkTCP(ctx, dial, address)
+	}
+	if backend.health.record(err, checker.config) {
+		if err != nil {
+			log.Printf("backend %s is unhealthy: %v", backend.Machine, err)
+		} else {
+			log.Printf("backend %s is healthy", backend.Machine)
+		}
+		checker.changed(backend, err)
+	}
+}
+
+func (checker *healthChecker) checkTCP(ctx context.Context, dial Dialer, address string) error {
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkHTTP requests the health check path, dial already does the TLS
+// handshake of secure backends.
+func (checker *healthChecker) checkHTTP(ctx context.Context, dial Dialer, secure bool, address string) error {
+	path := checker.config.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s%s", scheme, address, path), nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dial,
+			DialTLSContext:    dial,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if expected := checker.config.ExpectedStatus; expected != 0 && resp.StatusCode != expected {
+		return fmt.Errorf("unexpected status %d, expected %d", resp.StatusCode, expected)
+	} else if expected == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 400) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if len(checker.config.ExpectedBody) > 0 {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, healthCheckMaxBodyLength))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), checker.config.ExpectedBody) {
+			return fmt.Errorf("response body does not contain %q", checker.config.ExpectedBody)
+		}
+	}
+	return nil
+}
@@ -1,11 +1,19 @@
 package router
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"warptail/pkg/utils"
 
@@ -13,75 +21,509 @@ import (
 )
 
 type HTTPRoute struct {
-	config utils.RouteConfig
-	status RouterStatus
-	data   *utils.TimeSeries
-	*http.Client
+	lock      sync.RWMutex
+	config    utils.RouteConfig
+	status    RouterStatus
+	data      *utils.TimeSeries
+	paths     []pathMatcher
+	pool      *BackendPool
+	dial      Dialer
+	transport *http.Transport
+	counters  routeCounters
+	logs      *utils.AccessLog
+	geo       *GeoIP
+	events    *EventBus
+	requests  *drainer
+	rates     *routeRateLimits
+	access    *accessList
+	auth      authenticator
+	clients   *clientVerifier
 }
 
-func NewHTTPRoute(config utils.RouteConfig, server *tsnet.Server) *HTTPRoute {
+func NewHTTPRoute(config utils.RouteConfig, server *tsnet.Server, geo *GeoIP, events *EventBus) *HTTPRoute {
 	return &HTTPRoute{
 		config: config,
 		data:   utils.NewTimeSeries(time.Second, 1000),
+		logs:   utils.NewAccessLog(DEFAULT_ACCESS_LOG_SIZE),
 		status: STOPPED,
-		Client: server.HTTPClient(),
+		dial:   server.Dial,
+		geo:    geo,
+		events: events,
+	}
+}
+
+// setStatus changes the status of the route and publishes the change, it
+// must be called with lock held.
+func (route *HTTPRoute) setStatus(status RouterStatus) {
+	if route.status != status {
+		route.status = status
+		route.events.routeStatus(route.config, status)
 	}
 }
 
 func (route *HTTPRoute) Update(config utils.RouteConfig) error {
-	route.config = config
-	return nil
+	route.lock.Lock()
+	defer route.lock.Unlock()
+	return route.configure(config)
 }
+
 func (route *HTTPRoute) Start() error {
-	route.status = RUNNING
+	route.lock.Lock()
+	defer route.lock.Unlock()
+	if route.status == RUNNING {
+		return nil
+	}
+	return route.start()
+}
+
+func (route *HTTPRoute) start() error {
+	if err := route.configure(route.config); err != nil {
+		return err
+	}
+	route.startHealthChecks()
+	route.requests = newDrainer()
+	route.setStatus(RUNNING)
+	return nil
+}
+
+func (route *HTTPRoute) configure(config utils.RouteConfig) error {
+	paths, err := newPathMatchers(config.Paths, route.paths)
+	if err != nil {
+		return err
+	}
+	access, err := newAccessList(config.Access, route.geo)
+	if err != nil {
+		return err
+	}
+	auth, err := newAuthenticator(config.Name, config.Auth)
+	if err != nil {
+		return err
+	}
+	clients, err := newClientVerifier(config.TLS.ClientAuth)
+	if err != nil {
+		return err
+	}
+	if clients != nil && config.Type != utils.HTTPS {
+		return fmt.Errorf("client certificates need an https route")
+	}
+	machines := config.Machines()
+	for _, rule := range config.Paths {
+		machines = append(machines, rule.Machine)
+	}
+	backendTLS, err := loadBackendTLS(config.Type, machines)
+	if err != nil {
+		return err
+	}
+	if err := checkProxyProtocol(config); err != nil {
+		return err
+	}
+	route.stopHealthChecks()
+	if route.transport != nil {
+		route.transport.CloseIdleConnections()
+	}
+	route.config = config
+	route.paths = paths
+	route.rates = newRouteRateLimits(config.RateLimit)
+	route.access = access
+	route.auth = auth
+	route.clients = clients
+	route.pool = NewBackendPool(config.LoadBalancer, config.Machines(), route.pool)
+	tlsByAddress := make(map[string]*tls.Config, len(backendTLS))
+	for machine, tlsConfig := range backendTLS {
+		tlsByAddress[machine.String()] = tlsConfig
+	}
+	for _, pool := range route.pools() {
+		pool.useTLS(backendTLS)
+	}
+	dialTimeout := duration(config.DialTimeout, DEFAULT_DIAL_TIMEOUT)
+	base := route.backendDial(config)
+	dial := base.WithTimeout(dialTimeout)
+	route.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dial(ctx, network, address)
+			if err != nil {
+				return nil, &dialError{err: err}
+			}
+			return conn, nil
+		},
+		// https backends, the handshake counts as part of the dial
+		DialTLSContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			tlsConfig, ok := tlsByAddress[address]
+			if !ok {
+				return nil, &dialError{err: fmt.Errorf("%s is not an https backend", address)}
+			}
+			conn, err := base.WithTLS(tlsConfig).WithTimeout(dialTimeout)(ctx, network, address)
+			if err != nil {
+				return nil, &dialError{err: err}
+			}
+			return conn, nil
+		},
+		// a backend that accepts requests but never answers them counts as
+		// failing, the error reaches outlier detection like any other
+		ResponseHeaderTimeout: duration(config.ResponseHeaderTimeout, DEFAULT_RESPONSE_HEADER_TIMEOUT),
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		// the PROXY header names a single client, so its connection
+		// cannot be reused for another one
+		DisableKeepAlives: len(config.ProxyProtocol) > 0,
+	}
+	if route.status == RUNNING {
+		route.startHealthChecks()
+	}
 	return nil
 }
+
+// Stop turns new requests away and waits for the ones in flight to finish,
+// cancelling them after the drain timeout.
 func (route *HTTPRoute) Stop() error {
-	route.status = STOPPED
+	route.lock.Lock()
+	requests, timeout := route.stop(), route.config.DrainTimeout
+	route.lock.Unlock()
+	route.drain(requests, timeout)
 	return nil
 }
 
+// stop returns the requests of the run it stopped, or nil when the route was
+// not running.
+func (route *HTTPRoute) stop() *drainer {
+	route.stopHealthChecks()
+	if route.status != RUNNING {
+		return nil
+	}
+	route.setStatus(STOPPING)
+	requests := route.requests
+	route.requests = nil
+	return requests
+}
+
+func (route *HTTPRoute) drain(requests *drainer, timeout time.Duration) {
+	if requests == nil {
+		return
+	}
+	requests.drain(duration(timeout, DEFAULT_DRAIN_TIMEOUT))
+	route.lock.Lock()
+	if route.status == STOPPING {
+		route.setStatus(STOPPED)
+	}
+	route.lock.Unlock()
+}
+
+// backendDial connects to the backends of config, sending the PROXY header
+// of the request's client when the route has one.
+func (route *HTTPRoute) backendDial(config utils.RouteConfig) Dialer {
+	if len(config.ProxyProtocol) == 0 {
+		return route.dial
+	}
+	return route.dial.withContextProxyHeader(config.ProxyProtocol)
+}
+
+func (route *HTTPRoute) pools() []*BackendPool {
+	pools := []*BackendPool{route.pool}
+	for _, path := range route.paths {
+		pools = append(pools, path.pool)
+	}
+	return pools
+}
+
+func (route *HTTPRoute) startHealthChecks() {
+	for _, pool := range route.pools() {
+		pool.StartHealthChecks(route.config.HealthCheck, route.backendDial(route.config), route.events.healthChanges(route.config))
+	}
+}
+
+func (route *HTTPRoute) stopHealthChecks() {
+	for _, pool := range route.pools() {
+		pool.StopHealthChecks()
+	}
+}
+
 func (route *HTTPRoute) Status() RouterStatus {
+	route.lock.RLock()
+	defer route.lock.RUnlock()
 	return route.status
 }
 
 func (route *HTTPRoute) Config() utils.RouteConfig {
+	route.lock.RLock()
+	defer route.lock.RUnlock()
 	return route.config
 }
 
 func (route *HTTPRoute) Stats() utils.TimeSeriesData {
-	return route.data.Data
+	return route.data.Snapshot()
+}
+
+func (route *HTTPRoute) Traffic(t time.Time) utils.ProxyStats {
+	return route.data.At(t)
+}
+
+// log adds entry to the access log tagged with the client's country and
+// counts it in the per country stats.
+func (route *HTTPRoute) log(entry utils.AccessLogEntry) {
+	entry.Country = route.geo.Country(entry.ClientIP)
+	route.counters.record(entry)
+	route.logs.Add(entry)
+}
+
+func (route *HTTPRoute) AccessLog() *utils.AccessLog {
+	return route.logs
 }
 
-func parseRequestSize(header http.Header) (int64, error) {
-	contentLength := header.Get("Content-Length")
-	if contentLength == "" {
-		return 0, nil
+func (route *HTTPRoute) Counters() RouteCounters {
+	return route.counters.Snapshot()
+}
+
+func (route *HTTPRoute) Backends() []BackendInfo {
+	route.lock.RLock()
+	defer route.lock.RUnlock()
+	info := []BackendInfo{}
+	for _, pool := range route.pools() {
+		info = append(info, pool.Info()...)
+	}
+	return info
+}
+
+// clientVerifier checks the client certificates of the route's handshakes,
+// it is nil when the route does not ask for them.
+func (route *HTTPRoute) clientVerifier() *clientVerifier {
+	route.lock.RLock()
+	defer route.lock.RUnlock()
+	return route.clients
+}
+
+// Allow answers the requests of clients the access rules of the route
+// refuse with a 403 and logs them, it reports whether r may go on.
+func (route *HTTPRoute) Allow(w http.ResponseWriter, r *http.Request) bool {
+	route.lock.RLock()
+	access, config := route.access, route.config
+	route.lock.RUnlock()
+	ip := clientIP(r)
+	reason := access.denial(ip)
+	if len(reason) == 0 {
+		return true
 	}
-	return strconv.ParseInt(contentLength, 10, 64)
+	route.counters.denied.Add(1)
+	errorPage(w, http.StatusForbidden, fmt.Sprintf("Access to %s is denied.", config.Name))
+	route.log(utils.AccessLogEntry{
+		Time:     time.Now(),
+		Route:    config.Name,
+		Event:    utils.RequestEvent,
+		Protocol: config.Type,
+		ClientIP: ip,
+		Method:   r.Method,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		Status:   http.StatusForbidden,
+		Error:    reason,
+	})
+	return false
 }
 
 func (route *HTTPRoute) Handle(w http.ResponseWriter, r *http.Request) {
-	if route.status != RUNNING {
+	// the request keeps using the config it started with when the route is
+	// updated while it is in flight
+	route.lock.RLock()
+	status, config, pool, transport, rates, auth, clients := route.status, route.config, route.pool, route.transport, route.rates, route.auth, route.clients
+	path, matched := matchPath(route.paths, r.URL.Path)
+	requests := route.requests
+	if status == RUNNING {
+		requests.active.Add(1)
+	}
+	route.lock.RUnlock()
+	if status != RUNNING {
 		w.WriteHeader(http.StatusBadGateway)
 		return
 	}
+	defer requests.active.Done()
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	defer context.AfterFunc(requests.ctx, func() { cancel(errRouteStopped) })()
+	r = r.WithContext(ctx)
 
-	url, err := url.Parse(fmt.Sprintf("http://%s:%d", route.config.Machine.Address, route.config.Machine.Port))
-	proxy := httputil.NewSingleHostReverseProxy(url)
-	proxy.Transport = route.Transport
+	route.counters.requests.Add(1)
+	meter := newTrafficMeter(route.data)
+	meterRequest(r, meter)
+	mw := &meteredResponseWriter{ResponseWriter: w, meter: meter}
+	w = mw
+	start := time.Now()
+	entry := utils.AccessLogEntry{
+		Route:    config.Name,
+		Event:    utils.RequestEvent,
+		Protocol: config.Type,
+		ClientIP: clientIP(r),
+		Method:   r.Method,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+	}
+	defer func() {
+		entry.Time = start
+		entry.Status = mw.Status()
+		entry.Duration = time.Since(start)
+		entry.BytesSent = meter.BytesSent()
+		entry.BytesReceived = meter.BytesReceived()
+		route.log(entry)
+	}()
 
+	if wait, ok := rates.requests.reserve(entry.ClientIP); !ok {
+		route.counters.rejected.Add(1)
+		entry.Error = "rate limited"
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		errorPage(w, http.StatusTooManyRequests, fmt.Sprintf("too many requests to %s, slow down", config.Name))
+		return
+	}
+	release, err := route.counters.acquire(entry.ClientIP, config.Limits)
 	if err != nil {
-		w.WriteHeader(http.StatusBadGateway)
+		entry.Error = err.Error()
+		errorPage(w, http.StatusServiceUnavailable, fmt.Sprintf("%s is busy, try again later", config.Name))
+		return
+	}
+	defer release()
+
+	if clients != nil {
+		// the handshake already checked the certificate, but a connection
+		// may have been set up for another name or before the route asked
+		// for certificates
+		if r.TLS == nil || !strings.EqualFold(strings.TrimSuffix(r.TLS.ServerName, "."), config.Name) {
+			entry.Error = "misdirected request"
+			errorPage(w, http.StatusMisdirectedRequest, fmt.Sprintf("connect to %s directly", config.Name))
+			return
+		}
+		if err := clients.verify(r.TLS.PeerCertificates); err != nil {
+			route.counters.certRejected.Add(1)
+			entry.Error = err.Error()
+			errorPage(w, http.StatusForbidden, "A valid client certificate is required.")
+			return
+		}
+		clients.forward(r)
+	}
+
+	if auth != nil {
+		user, ok := auth.authenticate(w, r)
+		if !ok {
+			return
+		}
+		entry.User = user
+	}
+
+	// unmatched paths are only answered after auth so they do not reveal
+	// which paths exist, and the callback of oidc needs no backend
+	if matched {
+		pool = path.pool
+	} else if len(config.Backends) == 0 && len(config.Machine.Address) == 0 {
+		http.NotFound(w, r)
 		return
 	}
 
-	if size, err := parseRequestSize(r.Header); err == nil {
-		route.data.LogRecived(uint64(size))
+	attempts := 1
+	rewind := func() {}
+	if policy := config.Retry; policy.Attempts > 1 && idempotent(r) {
+		maxBodySize := policy.MaxBodySize
+		if maxBodySize <= 0 {
+			maxBodySize = DEFAULT_RETRY_BODY_SIZE
+		}
+		if replay, ok := bufferBody(r, maxBodySize); ok {
+			attempts, rewind = policy.Attempts, replay
+		}
 	}
 
-	proxy.ServeHTTP(w, r)
-	if size, err := parseRequestSize(w.Header()); err == nil {
-		route.data.LogSent(uint64(size))
+	if len(config.ProxyProtocol) > 0 {
+		r = withProxyHeader(r, config.ProxyProtocol)
+	}
+
+	tried := []*Backend{}
+	for attempt := 1; ; attempt++ {
+		backend, err := pool.Next(entry.ClientIP, tried...)
+		if err != nil {
+			entry.Error = err.Error()
+			errorPage(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		tried = append(tried, backend)
+		entry.Backend = backend.Machine.String()
+		if attempt > 1 {
+			route.counters.retries.Add(1)
+			rewind()
+		}
+		if !route.forward(w, r, config, transport, backend, attempt < attempts) {
+			return
+		}
+	}
+}
+
+// forward proxies a single attempt of r to backend. When canRetry is set a
+// failure matching the retry policy is not written to w, forward returns
+// true instead so the caller can try again.
+func (route *HTTPRoute) forward(w http.ResponseWriter, r *http.Request, config utils.RouteConfig, transport *http.Transport, backend *Backend, canRetry bool) (retry bool) {
+	defer backend.Acquire()()
+	scheme := "http"
+	if backend.Secure() {
+		scheme = "https"
+	}
+	url, err := url.Parse(fmt.Sprintf("%s://%s", scheme, backend.Machine))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return false
+	}
+	meter := newTrafficMeter(backend.data)
+	meterRequest(r, meter)
+	w = &meteredResponseWriter{ResponseWriter: w, meter: meter}
+
+	policy := config.Retry
+	outlier := config.OutlierDetection
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	stopTimer := func() bool { return false }
+	if policy.PerTryTimeout > 0 {
+		timer := time.AfterFunc(policy.PerTryTimeout, func() { cancel(errPerTryTimeout) })
+		stopTimer = timer.Stop
+		defer timer.Stop()
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(url)
+	proxy.Transport = transport
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		stopTimer()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			backend.Report(fmt.Errorf("backend responded %s", resp.Status), outlier)
+		} else {
+			backend.Report(nil, outlier)
+		}
+		if canRetry && retryableStatus(policy, resp.StatusCode) {
+			return &retryStatusError{status: resp.Status}
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		var statusErr *retryStatusError
+		if errors.As(err, &statusErr) {
+			retry = true
+			return
+		}
+		if r.Context().Err() != nil {
+			// the client went away or the route was stopped, this says
+			// nothing about the backend
+			backend.breaker.cancel()
+			if errors.Is(context.Cause(r.Context()), errRouteStopped) {
+				errorPage(w, http.StatusServiceUnavailable, fmt.Sprintf("%s was stopped", config.Name))
+			}
+			return
+		}
+		if cause := context.Cause(ctx); errors.Is(cause, errPerTryTimeout) {
+			err = cause
+		}
+		backend.Report(err, outlier)
+		if canRetry && retryableError(policy, err) {
+			retry = true
+			return
+		}
+		log.Printf("proxy to %s failed: %v", backend.Machine, err)
+		var netErr net.Error
+		if errors.Is(err, errPerTryTimeout) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			errorPage(w, http.StatusGatewayTimeout, fmt.Sprintf("%s did not respond in time", config.Name))
+			return
+		}
+		errorPage(w, http.StatusBadGateway, fmt.Sprintf("%s could not be reached", config.Name))
 	}
+	proxy.ServeHTTP(w, r.WithContext(ctx))
+	return retry
 }
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"crypto/tls"
+	"warptail/pkg/utils"
+
+	"tailscale.com/tsnet"
+)
+
+// HTTPSRoute is an HTTPRoute served on the TLS listener. Its certificate is
+// loaded into the router's CertStore while the route is running.
+type HTTPSRoute struct {
+	*HTTPRoute
+	certs *CertStore
+}
+
+func NewHTTPSRoute(config utils.RouteConfig, server *tsnet.Server, certs *CertStore, geo *GeoIP, events *EventBus) *HTTPSRoute {
+	return &HTTPSRoute{
+		HTTPRoute: NewHTTPRoute(config, server, geo, events),
+		certs:     certs,
+	}
+}
+
+// Update applies config in place like HTTPRoute.Update. The certificate is
+// read before anything changes, so a route with a bad config keeps serving
+// the old one.
+func (route *HTTPSRoute) Update(config utils.RouteConfig) error {
+	route.lock.Lock()
+	defer route.lock.Unlock()
+	if route.status != RUNNING {
+		return route.configure(config)
+	}
+	cert, err := route.certificate(config)
+	if err != nil {
+		return err
+	}
+	previous := route.config.Name
+	if err := route.configure(config); err != nil {
+		return err
+	}
+	route.certs.Remove(previous)
+	if cert != nil {
+		route.certs.Set(config.Name, cert)
+	}
+	return nil
+}
+
+func (route *HTTPSRoute) Start() error {
+	route.lock.Lock()
+	defer route.lock.Unlock()
+	if route.status == RUNNING {
+		return nil
+	}
+	return route.start()
+}
+
+func (route *HTTPSRoute) start() error {
+	cert, err := route.certificate(route.config)
+	if err != nil {
+		return err
+	}
+	if err := route.HTTPRoute.start(); err != nil {
+		return err
+	}
+	if cert != nil {
+		route.certs.Set(route.config.Name, cert)
+	}
+	return nil
+}
+
+// certificate loads the certificate of config, it is nil for routes without
+// a cert_file.
+func (route *HTTPSRoute) certificate(config utils.RouteConfig) (*tls.Certificate, error) {
+	if len(config.TLS.CertFile) == 0 {
+		return nil, nil
+	}
+	return loadCertificate(config.Name, config.TLS.CertFile, config.TLS.KeyFile)
+}
+
+func (route *HTTPSRoute) Stop() error {
+	route.lock.Lock()
+	requests, timeout := route.stop(), route.config.DrainTimeout
+	route.lock.Unlock()
+	route.drain(requests, timeout)
+	return nil
+}
+
+func (route *HTTPSRoute) stop() *drainer {
+	route.certs.Remove(route.config.Name)
+	return route.HTTPRoute.stop()
+}
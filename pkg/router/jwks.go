@@ -0,0 +1,195 @@
+package router
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	DEFAULT_JWKS_TTL = time.Hour
+	// jwksMinRefresh stops tokens with unknown key ids from making us
+	// refetch the key set on every request.
+	jwksMinRefresh = time.Minute
+)
+
+var errUnknownKey = errors.New("token is signed with an unknown key")
+
+// jwtAlgorithms are the asymmetric signing methods accepted for tokens
+// verified against a key set.
+var jwtAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// authHTTPClient talks to identity providers. They are reached over the
+// internet, not the tailnet.
+var authHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwks is a JSON Web Key Set fetched from url. It is cached for ttl and
+// refreshed early when a token names a key id we do not know, which is
+// how providers roll their keys.
+type jwks struct {
+	url       string
+	ttl       time.Duration
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	refreshed time.Time
+}
+
+func newJWKS(url string, ttl time.Duration) *jwks {
+	return &jwks{url: url, ttl: duration(ttl, DEFAULT_JWKS_TTL)}
+}
+
+// Keyfunc looks up the key a token was signed with, for jwt.Parse. The key
+// set is fetched without holding mu so a slow provider only holds up the
+// requests that need the new keys.
+func (set *jwks) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	set.mu.Lock()
+	_, known := set.keys[kid]
+	stale := time.Since(set.fetched) > set.ttl
+	refresh := (!known || stale) && time.Since(set.refreshed) > jwksMinRefresh
+	if refresh {
+		// other requests keep using the keys we have in the meantime
+		set.refreshed = time.Now()
+	}
+	set.mu.Unlock()
+
+	var err error
+	if refresh {
+		var keys map[string]crypto.PublicKey
+		keys, err = set.fetch()
+		set.mu.Lock()
+		if err == nil {
+			set.keys = keys
+			set.fetched = time.Now()
+		}
+		set.mu.Unlock()
+	}
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if set.keys == nil {
+		if err == nil {
+			err = fmt.Errorf("jwks %s is not fetched yet", set.url)
+		}
+		return nil, err
+	}
+	if key, ok := set.keys[kid]; ok {
+		return key, nil
+	}
+	if len(kid) == 0 && len(set.keys) == 1 {
+		for _, key := range set.keys {
+			return key, nil
+		}
+	}
+	return nil, errUnknownKey
+}
+
+func (set *jwks) fetch() (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), authHTTPClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, set.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch jwks: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch jwks: %s", resp.Status)
+	}
+	var body struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(body.Keys))
+	for _, jwk := range body.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// keys of unsupported types are skipped, not fatal
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if _, err := key.ECDH(); err != nil {
+			return nil, fmt.Errorf("invalid %s key", jwk.Crv)
+		}
+		return key, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+	}
+}
@@ -0,0 +1,55 @@
+package router
+
+import (
+	"errors"
+	"sync"
+	"warptail/pkg/utils"
+)
+
+var (
+	ErrRouteLimit  = errors.New("route is at its connection limit")
+	ErrClientLimit = errors.New("client is at its connection limit")
+)
+
+// connLimiter counts the open connections of a route per client IP. It is
+// shared by every run of a route so connections still draining after an
+// update count towards the limits of the new config.
+type connLimiter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// acquire claims a connection for ip, the returned func gives it back.
+func (limiter *connLimiter) acquire(ip string, limits utils.ConnectionLimits) (func(), error) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limits.MaxConnections > 0 && limiter.total >= limits.MaxConnections {
+		return nil, ErrRouteLimit
+	}
+	if limits.MaxConnectionsPerIP > 0 && limiter.perIP[ip] >= limits.MaxConnectionsPerIP {
+		return nil, ErrClientLimit
+	}
+	if limiter.perIP == nil {
+		limiter.perIP = make(map[string]int)
+	}
+	limiter.total++
+	limiter.perIP[ip]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limiter.mu.Lock()
+			defer limiter.mu.Unlock()
+			limiter.total--
+			if limiter.perIP[ip]--; limiter.perIP[ip] <= 0 {
+				delete(limiter.perIP, ip)
+			}
+		})
+	}, nil
+}
+
+func (limiter *connLimiter) active() int64 {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return int64(limiter.total)
+}
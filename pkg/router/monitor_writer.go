@@ -1,8 +1,13 @@
 package router
 
 import (
+	"bufio"
+	"io"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"warptail/pkg/utils"
 )
 
 type ConnMonitor struct {
@@ -47,3 +52,125 @@ func (crw *ConnMonitor) BytesWritten() int64 {
 	defer crw.mu.Unlock()
 	return crw.bytesWritten
 }
+
+// trafficMeter records bytes into the stats of a route or backend as they
+// pass and keeps totals for the access log. Received is traffic from the
+// client, sent is traffic to it.
+type trafficMeter struct {
+	data          *utils.TimeSeries
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+}
+
+func newTrafficMeter(data *utils.TimeSeries) *trafficMeter {
+	return &trafficMeter{data: data}
+}
+
+func (meter *trafficMeter) received(n int) {
+	if n > 0 {
+		meter.bytesReceived.Add(uint64(n))
+		meter.data.LogRecived(uint64(n))
+	}
+}
+
+func (meter *trafficMeter) sent(n int) {
+	if n > 0 {
+		meter.bytesSent.Add(uint64(n))
+		meter.data.LogSent(uint64(n))
+	}
+}
+
+func (meter *trafficMeter) BytesSent() uint64 {
+	return meter.bytesSent.Load()
+}
+
+func (meter *trafficMeter) BytesReceived() uint64 {
+	return meter.bytesReceived.Load()
+}
+
+// meteredBody counts the bytes of a request body read by the proxy.
+type meteredBody struct {
+	io.ReadCloser
+	meter *trafficMeter
+}
+
+func (body *meteredBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.meter.received(n)
+	return n, err
+}
+
+// meterRequest counts the body of r as it is read.
+func meterRequest(r *http.Request, meter *trafficMeter) {
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &meteredBody{ReadCloser: r.Body, meter: meter}
+	}
+}
+
+// meteredConn counts both directions of a hijacked client connection, such
+// as an upgraded WebSocket.
+type meteredConn struct {
+	net.Conn
+	meter *trafficMeter
+}
+
+func (conn *meteredConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	conn.meter.received(n)
+	return n, err
+}
+
+func (conn *meteredConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	conn.meter.sent(n)
+	return n, err
+}
+
+// meteredResponseWriter counts the response bytes written to the client
+// whatever the framing, including after the connection is hijacked.
+type meteredResponseWriter struct {
+	http.ResponseWriter
+	meter  *trafficMeter
+	status int
+}
+
+func (w *meteredResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Status returns the status code sent to the client, 0 if nothing was sent.
+func (w *meteredResponseWriter) Status() int {
+	return w.status
+}
+
+func (w *meteredResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.meter.sent(n)
+	return n, err
+}
+
+func (w *meteredResponseWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *meteredResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	metered := &meteredConn{Conn: conn, meter: w.meter}
+	return metered, bufio.NewReadWriter(brw.Reader, bufio.NewWriter(metered)), nil
+}
+
+func (w *meteredResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
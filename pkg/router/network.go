@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 	"warptail/pkg/utils"
@@ -14,145 +15,370 @@ import (
 )
 
 type NetworkRoute struct {
+	lock     sync.RWMutex
 	config   utils.RouteConfig
 	status   RouterStatus
 	client   *tailscale.LocalClient
 	data     *utils.TimeSeries
+	pool     *BackendPool
+	counters routeCounters
+	logs     *utils.AccessLog
+	geo      *GeoIP
+	events   *EventBus
+	current  *networkListener
+}
+
+// networkListener is a single run of a NetworkRoute. It keeps the config it
+// was started with so its connections can drain after an update while the
+// next run already accepts new ones.
+type networkListener struct {
+	*drainer
 	listener *net.TCPListener
+	config   utils.RouteConfig
+	pool     *BackendPool
+	rates    *routeRateLimits
+	access   *accessList
 	quit     chan bool
 	exited   chan bool
 }
 
-func NewNetworkRoute(config utils.RouteConfig, client *tailscale.LocalClient) *NetworkRoute {
+func NewNetworkRoute(config utils.RouteConfig, client *tailscale.LocalClient, geo *GeoIP, events *EventBus) *NetworkRoute {
 	return &NetworkRoute{
 		config: config,
 		data:   utils.NewTimeSeries(time.Second, 1000),
+		logs:   utils.NewAccessLog(DEFAULT_ACCESS_LOG_SIZE),
 		status: STOPPED,
 		client: client,
+		geo:    geo,
+		events: events,
+		pool:   NewBackendPool(config.LoadBalancer, config.Machines(), nil),
+	}
+}
+
+// setStatus changes the status of the route and publishes the change, it
+// must be called with lock held.
+func (route *NetworkRoute) setStatus(status RouterStatus) {
+	if route.status != status {
+		route.status = status
+		route.events.routeStatus(route.config, status)
 	}
 }
 
 func (route *NetworkRoute) Status() RouterStatus {
+	route.lock.RLock()
+	defer route.lock.RUnlock()
 	return route.status
 }
 
 func (route *NetworkRoute) Config() utils.RouteConfig {
+	route.lock.RLock()
+	defer route.lock.RUnlock()
 	return route.config
 }
 
 func (route *NetworkRoute) Stats() utils.TimeSeriesData {
-	return route.data.Data
+	return route.data.Snapshot()
+}
+
+func (route *NetworkRoute) Traffic(t time.Time) utils.ProxyStats {
+	return route.data.At(t)
+}
+
+// log adds entry to the access log tagged with the client's country and
+// counts it in the per country stats.
+func (route *NetworkRoute) log(entry utils.AccessLogEntry) {
+	entry.Country = route.geo.Country(entry.ClientIP)
+	route.counters.record(entry)
+	route.logs.Add(entry)
+}
+
+func (route *NetworkRoute) AccessLog() *utils.AccessLog {
+	return route.logs
+}
+
+func (route *NetworkRoute) Counters() RouteCounters {
+	return route.counters.Snapshot()
+}
+
+func (route *NetworkRoute) Backends() []BackendInfo {
+	route.lock.RLock()
+	defer route.lock.RUnlock()
+	return route.pool.Info()
 }
 
+// Update restarts a running route with the new config. Connections of the
+// previous config are drained in the background. A config that does not
+// validate leaves the route running as it was.
 func (route *NetworkRoute) Update(config utils.RouteConfig) error {
-	route.Stop()
+	route.lock.Lock()
+	defer route.lock.Unlock()
+	pool := NewBackendPool(config.LoadBalancer, config.Machines(), route.pool)
+	if route.status != RUNNING {
+		route.config = config
+		route.pool = pool
+		return nil
+	}
+	next, err := route.prepare(config, pool)
+	if err != nil {
+		return err
+	}
+	previous := route.stop()
 	route.config = config
-	return route.Start()
+	route.pool = pool
+	if previous != nil {
+		go previous.drain(duration(previous.config.DrainTimeout, DEFAULT_DRAIN_TIMEOUT))
+	}
+	return route.listen(next)
 }
 
+// Stop stops accepting connections and waits for the open ones to finish,
+// closing them after the drain timeout.
 func (route *NetworkRoute) Stop() error {
-	route.status = STOPPING
-	close(route.quit)
-	<-route.exited
+	route.lock.Lock()
+	previous := route.stop()
+	route.lock.Unlock()
+	if previous == nil {
+		return nil
+	}
+	previous.drain(duration(previous.config.DrainTimeout, DEFAULT_DRAIN_TIMEOUT))
+	route.lock.Lock()
+	if route.status == STOPPING {
+		route.setStatus(STOPPED)
+	}
+	route.lock.Unlock()
 	fmt.Println("Stopped successfully")
-	route.status = STOPPED
 	return nil
 }
 
+// stop closes the listener of the current run and returns it so its
+// connections can be drained, or nil when the route is not running.
+func (route *NetworkRoute) stop() *networkListener {
+	current := route.current
+	if route.status != RUNNING || current == nil {
+		return nil
+	}
+	route.setStatus(STOPPING)
+	route.current = nil
+	current.pool.StopHealthChecks()
+	close(current.quit)
+	current.listener.Close()
+	<-current.exited
+	return current
+}
+
 func (route *NetworkRoute) Start() error {
+	route.lock.Lock()
+	defer route.lock.Unlock()
 	if route.status == RUNNING {
-		route.Stop()
+		return nil
 	}
-	route.status = STARTING
-	laddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", route.config.Port))
+	return route.start()
+}
+
+func (route *NetworkRoute) start() error {
+	route.setStatus(STARTING)
+	next, err := route.prepare(route.config, route.pool)
 	if err != nil {
+		route.setStatus(STOPPED)
 		return err
 	}
-	route.quit = make(chan bool)
-	route.exited = make(chan bool)
+	return route.listen(next)
+}
 
-	route.listener, err = net.ListenTCP("tcp", laddr)
+// prepare checks config and builds the run it starts, without opening its
+// listener.
+func (route *NetworkRoute) prepare(config utils.RouteConfig, pool *BackendPool) (*networkListener, error) {
+	access, err := newAccessList(config.Access, route.geo)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	backendTLS, err := loadBackendTLS(config.Type, config.Machines())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkProxyProtocol(config); err != nil {
+		return nil, err
+	}
+	pool.useTLS(backendTLS)
+	return &networkListener{
+		drainer: newDrainer(),
+		config:  config,
+		pool:    pool,
+		rates:   newRouteRateLimits(config.RateLimit),
+		access:  access,
+		quit:    make(chan bool),
+		exited:  make(chan bool),
+	}, nil
+}
 
-	go route.serve()
-	route.status = RUNNING
+// listen opens the listener of run l and serves it.
+func (route *NetworkRoute) listen(l *networkListener) error {
+	laddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", l.config.Port))
+	if err != nil {
+		route.setStatus(STOPPED)
+		return err
+	}
+	listener, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		route.setStatus(STOPPED)
+		return err
+	}
+	l.listener = listener
+	route.current = l
+	healthDial := localClientDialer(route.client)
+	if version := l.config.ProxyProtocol; len(version) > 0 {
+		healthDial = healthDial.WithProxyHeader(proxyHeader(version, false, netip.AddrPort{}, netip.AddrPort{}))
+	}
+	l.pool.StartHealthChecks(l.config.HealthCheck, healthDial, route.events.healthChanges(l.config))
+	go route.serve(l)
+	route.setStatus(RUNNING)
 	return nil
 }
 
-func (route *NetworkRoute) serve() {
-	var handlers sync.WaitGroup
+func (route *NetworkRoute) serve(l *networkListener) {
+	defer close(l.exited)
 	for {
-		select {
-		case <-route.quit:
-			fmt.Println("Shutting down...")
-			route.listener.Close()
-			handlers.Wait()
-			close(route.exited)
-			return
-		default:
-			//fmt.Println("Listening for clients")
-			route.listener.SetDeadline(time.Now().Add(1e9))
-			conn, err := route.listener.Accept()
-			if err != nil {
-				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-					continue
-				}
-				fmt.Println("Failed to accept connection:", err.Error())
+		conn, err := l.listener.Accept()
+		if err != nil {
+			select {
+			case <-l.quit:
+				fmt.Println("Shutting down...")
+				return
+			default:
 			}
-			handlers.Add(1)
-			go func() {
-				route.handleConnection(conn)
-				handlers.Done()
-			}()
+			fmt.Println("Failed to accept connection:", err.Error())
+			continue
+		}
+		clientIP := hostIP(conn.RemoteAddr().String())
+		if !route.counters.allowed(l.access, clientIP) {
+			conn.Close()
+			continue
+		}
+		release, err := route.counters.acquire(clientIP, l.config.Limits)
+		if err == nil && !l.rates.allowConnection() {
+			release()
+			route.counters.rejected.Add(1)
+			err = ErrConnectionRate
 		}
+		if err != nil {
+			conn.Close()
+			route.log(utils.AccessLogEntry{
+				Time:     time.Now(),
+				Route:    l.config.Name,
+				Event:    utils.CloseEvent,
+				Protocol: l.config.Type,
+				ClientIP: clientIP,
+				Error:    err.Error(),
+			})
+			continue
+		}
+		l.active.Add(1)
+		go func() {
+			defer l.active.Done()
+			defer release()
+			route.handleConnection(l, conn)
+		}()
 	}
 }
 
-func (route *NetworkRoute) handleConnection(conn net.Conn) {
-	proxy, err := route.client.UserDial(context.Background(), string(route.config.Type), route.config.Machine.Address, route.config.Machine.Port)
+func (route *NetworkRoute) handleConnection(l *networkListener, conn net.Conn) {
+	defer conn.Close()
+	route.counters.requests.Add(1)
+	start := time.Now()
+	entry := utils.AccessLogEntry{
+		Time:     start,
+		Route:    l.config.Name,
+		Event:    utils.OpenEvent,
+		Protocol: l.config.Type,
+		ClientIP: hostIP(conn.RemoteAddr().String()),
+	}
+	backend, err := l.pool.Next(entry.ClientIP)
+	if err != nil {
+		log.Printf("%s: rejecting %s: %v", l.config.Name, conn.RemoteAddr(), err)
+		entry.Event, entry.Error = utils.CloseEvent, err.Error()
+		route.log(entry)
+		return
+	}
+	entry.Backend = backend.Machine.String()
+	base := localClientDialer(route.client)
+	if version := l.config.ProxyProtocol; len(version) > 0 {
+		base = base.WithProxyHeader(proxyHeader(version, false, addrPort(conn.RemoteAddr()), addrPort(conn.LocalAddr())))
+	}
+	dial := backend.dialer(base).WithTimeout(duration(l.config.DialTimeout, DEFAULT_DIAL_TIMEOUT))
+	proxy, err := dial(l.ctx, string(l.config.Type), backend.Machine.String())
+	backend.Report(err, l.config.OutlierDetection)
 	if err != nil {
 		log.Printf("remote connection failed: %v", err)
+		entry.Event, entry.Error, entry.Duration = utils.CloseEvent, err.Error(), time.Since(start)
+		route.log(entry)
 		return
 	}
+	defer proxy.Close()
+	defer backend.Acquire()()
+	route.log(entry)
 
-	sendWriter := &ConnMonitor{rw: proxy}
-	reciveWriter := &ConnMonitor{rw: conn}
+	client := &ConnMonitor{rw: conn}
+	defer func() {
+		entry.Time = time.Now()
+		entry.Event = utils.CloseEvent
+		entry.Duration = time.Since(start)
+		entry.BytesReceived = uint64(client.BytesRead())
+		entry.BytesSent = uint64(client.BytesWritten())
+		route.log(entry)
+	}()
+	done := make(chan bool)
 
 	wg := &sync.WaitGroup{}
-	wg.Add(3)
-	go route.copy(reciveWriter, sendWriter, wg)
-	go route.copy(sendWriter, reciveWriter, wg)
-	go route.monitor(sendWriter, reciveWriter, wg)
-	wg.Wait()
+	wg.Add(2)
+	go route.copy(shape(l.ctx, client, l.rates.received), proxy, wg)
+	go route.copy(shape(l.ctx, proxy, l.rates.sent), client, wg)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	route.monitor(l.ctx, client, proxy, backend, done)
 }
-func (route *NetworkRoute) monitor(to, from *ConnMonitor, wg *sync.WaitGroup) {
-	defer wg.Done()
+
+// monitor logs the traffic of a connection every second until it is done,
+// closing it once ctx is cancelled at the end of the drain timeout. Bytes
+// read from the client are counted as received and bytes written to it as
+// sent.
+func (route *NetworkRoute) monitor(ctx context.Context, client *ConnMonitor, proxy net.Conn, backend *Backend, done chan bool) {
 	ticker := time.NewTicker(1 * time.Second)
-	for range ticker.C {
+	defer ticker.Stop()
+	var received, sent int64
+	logTraffic := func() {
+		read, written := client.BytesRead(), client.BytesWritten()
+		route.data.LogRecived(uint64(read - received))
+		route.data.LogSent(uint64(written - sent))
+		backend.data.LogRecived(uint64(read - received))
+		backend.data.LogSent(uint64(written - sent))
+		received, sent = read, written
+	}
+	for {
 		select {
-		case <-route.quit:
-			to.Close()
-			from.Close()
+		case <-done:
+			logTraffic()
 			return
-		default:
-			route.data.LogRecived(uint64(to.bytesRead))
-			route.data.LogSent(uint64(to.bytesWritten))
+		case <-ctx.Done():
+			client.Close()
+			proxy.Close()
+			<-done
+			logTraffic()
+			return
+		case <-ticker.C:
+			logTraffic()
 		}
 	}
 }
 
-func (route *NetworkRoute) copy(from, to io.ReadWriter, wg *sync.WaitGroup) {
+// copy pipes one direction of a connection. Once either direction is
+// finished both sides are closed so the other copy unblocks as well.
+func (route *NetworkRoute) copy(from io.ReadCloser, to io.WriteCloser, wg *sync.WaitGroup) {
 	defer wg.Done()
-	select {
-	case <-route.quit:
-		return
-	default:
-		if _, err := io.Copy(to, from); err != nil {
-			return
-		}
-	}
+	io.Copy(to, from)
+	from.Close()
+	to.Close()
 }
 
 // func (route *NetworkRoute) handle(src io.Reader, dst io.Writer) {
@@ -0,0 +1,443 @@
+package router
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"warptail/pkg/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+const (
+	OIDC_CALLBACK_PATH       = "/.warptail/oidc/callback"
+	OIDC_LOGOUT_PATH         = "/.warptail/oidc/logout"
+	DEFAULT_SESSION_DURATION = 24 * time.Hour
+	DEFAULT_GROUPS_CLAIM     = "groups"
+
+	sessionCookie = "warptail_session"
+	stateCookie   = "warptail_oidc_state"
+	// stateDuration is how long a visitor has to sign in at the provider.
+	stateDuration = 10 * time.Minute
+)
+
+var errInvalidCookie = errors.New("invalid cookie")
+
+// sessionSecret signs the cookies of routes without a cookie secret. It is
+// new on every start, so their sessions do not survive a restart.
+var sessionSecret = sync.OnceValue(func() []byte {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return secret
+})
+
+// identity is what a session cookie holds about the visitor.
+type identity struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	Expires int64    `json:"exp"`
+}
+
+func (id identity) user() string {
+	if len(id.Email) > 0 {
+		return id.Email
+	}
+	return id.Subject
+}
+
+// loginState ties the callback to the sign in it started.
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+	Expires  int64  `json:"exp"`
+}
+
+type oidcProvider struct {
+	endpoint oauth2.Endpoint
+	keys     *jwks
+}
+
+// oidcAuth sends visitors without a session to the provider to sign in and
+// answers the provider's callback on OIDC_CALLBACK_PATH. The provider is
+// discovered on the first request so a provider that is down does not keep
+// the route from starting.
+type oidcAuth struct {
+	config utils.OIDCConfig
+	// sessionKey and stateKey sign the two cookies, one is never accepted
+	// in place of the other.
+	sessionKey []byte
+	stateKey   []byte
+	mu         sync.Mutex
+	oidc       *oidcProvider
+}
+
+// newOIDCAuth builds the authenticator of route name. The cookie keys are
+// derived from the route name so a session of one route is not accepted by
+// another.
+func newOIDCAuth(name string, config utils.OIDCConfig) (*oidcAuth, error) {
+	if len(config.ClientID) == 0 {
+		return nil, fmt.Errorf("oidc needs a client_id")
+	}
+	if !strings.HasPrefix(config.Issuer, "https://") && !strings.HasPrefix(config.Issuer, "http://") {
+		return nil, fmt.Errorf("oidc issuer %q is not a url", config.Issuer)
+	}
+	secret := sessionSecret()
+	if len(config.CookieSecret) > 0 {
+		secret = []byte(config.CookieSecret)
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	} else if !slices.Contains(config.Scopes, "openid") {
+		config.Scopes = append([]string{"openid"}, config.Scopes...)
+	}
+	if len(config.GroupsClaim) == 0 {
+		config.GroupsClaim = DEFAULT_GROUPS_CLAIM
+	}
+	config.SessionDuration = duration(config.SessionDuration, DEFAULT_SESSION_DURATION)
+	return &oidcAuth{
+		config:     config,
+		sessionKey: cookieKey(secret, "session|"+name),
+		stateKey:   cookieKey(secret, "state|"+name),
+	}, nil
+}
+
+func cookieKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (auth *oidcAuth) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch r.URL.Path {
+	case OIDC_CALLBACK_PATH:
+		auth.callback(w, r)
+		return "", false
+	case OIDC_LOGOUT_PATH:
+		http.SetCookie(w, auth.cookie(r, sessionCookie, "/", "", -1))
+		http.Redirect(w, r, "/", http.StatusFound)
+		return "", false
+	}
+	var id identity
+	if cookie, err := r.Cookie(sessionCookie); err == nil && auth.decode(auth.sessionKey, cookie.Value, &id) == nil &&
+		len(id.Subject) > 0 && time.Now().Unix() < id.Expires && auth.allowed(id) {
+		auth.forward(r, id)
+		return id.user(), true
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		errorPage(w, http.StatusUnauthorized, "Sign in to continue.")
+		return "", false
+	}
+	auth.login(w, r)
+	return "", false
+}
+
+// login redirects to the provider, remembering where the visitor was going.
+func (auth *oidcAuth) login(w http.ResponseWriter, r *http.Request) {
+	provider, err := auth.provider(r.Context())
+	if err != nil {
+		log.Printf("oidc discovery for %s failed: %v", auth.config.Issuer, err)
+		errorPage(w, http.StatusBadGateway, "The sign in provider could not be reached.")
+		return
+	}
+	state := loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: oauth2.GenerateVerifier(),
+		Redirect: r.URL.RequestURI(),
+		Expires:  time.Now().Add(stateDuration).Unix(),
+	}
+	value, err := auth.encode(auth.stateKey, state)
+	if err != nil {
+		errorPage(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	http.SetCookie(w, auth.cookie(r, stateCookie, OIDC_CALLBACK_PATH, value, int(stateDuration.Seconds())))
+	url := auth.oauth2(r, provider).AuthCodeURL(state.State,
+		oauth2.S256ChallengeOption(state.Verifier),
+		oauth2.SetAuthURLParam("nonce", state.Nonce))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// callback exchanges the code from the provider for an id token and starts
+// the session.
+func (auth *oidcAuth) callback(w http.ResponseWriter, r *http.Request) {
+	var state loginState
+	cookie, err := r.Cookie(stateCookie)
+	if err != nil || auth.decode(auth.stateKey, cookie.Value, &state) != nil || time.Now().Unix() > state.Expires {
+		errorPage(w, http.StatusBadRequest, "The sign in expired, try again.")
+		return
+	}
+	http.SetCookie(w, auth.cookie(r, stateCookie, OIDC_CALLBACK_PATH, "", -1))
+	query := r.URL.Query()
+	if reason := query.Get("error"); len(reason) > 0 {
+		errorPage(w, http.StatusForbidden, fmt.Sprintf("Sign in failed: %s", reason))
+		return
+	}
+	if !hmac.Equal([]byte(query.Get("state")), []byte(state.State)) {
+		errorPage(w, http.StatusBadRequest, "The sign in expired, try again.")
+		return
+	}
+	provider, err := auth.provider(r.Context())
+	if err != nil {
+		errorPage(w, http.StatusBadGateway, "The sign in provider could not be reached.")
+		return
+	}
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, authHTTPClient)
+	token, err := auth.oauth2(r, provider).Exchange(ctx, query.Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		log.Printf("oidc code exchange with %s failed: %v", auth.config.Issuer, err)
+		errorPage(w, http.StatusBadGateway, "The sign in could not be completed.")
+		return
+	}
+	id, err := auth.verify(token, provider, state.Nonce)
+	if err != nil {
+		log.Printf("oidc id token from %s rejected: %v", auth.config.Issuer, err)
+		errorPage(w, http.StatusBadGateway, "The sign in could not be completed.")
+		return
+	}
+	if !auth.allowed(id) {
+		errorPage(w, http.StatusForbidden, fmt.Sprintf("%s is not allowed here.", id.user()))
+		return
+	}
+	id.Expires = time.Now().Add(auth.config.SessionDuration).Unix()
+	value, err := auth.encode(auth.sessionKey, id)
+	if err != nil {
+		errorPage(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	http.SetCookie(w, auth.cookie(r, sessionCookie, "/", value, int(auth.config.SessionDuration.Seconds())))
+	http.Redirect(w, r, localRedirect(state.Redirect), http.StatusFound)
+}
+
+// verify checks the id token of a code exchange and reads the identity
+// from it.
+func (auth *oidcAuth) verify(token *oauth2.Token, provider *oidcProvider, nonce string) (identity, error) {
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return identity{}, fmt.Errorf("no id_token in token response")
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, provider.keys.Keyfunc,
+		jwt.WithValidMethods(jwtAlgorithms),
+		jwt.WithIssuer(auth.config.Issuer),
+		jwt.WithAudience(auth.config.ClientID),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return identity{}, err
+	}
+	if claims["nonce"] != nonce {
+		return identity{}, fmt.Errorf("nonce mismatch")
+	}
+	id := identity{}
+	id.Subject, _ = claims["sub"].(string)
+	if len(id.Subject) == 0 {
+		return identity{}, fmt.Errorf("id token has no subject")
+	}
+	// an address the provider did not verify could belong to anyone
+	if verified, ok := claims["email_verified"].(bool); !ok || verified {
+		id.Email, _ = claims["email"].(string)
+	}
+	switch groups := claims[auth.config.GroupsClaim].(type) {
+	case string:
+		id.Groups = []string{groups}
+	case []interface{}:
+		for _, group := range groups {
+			if group, ok := group.(string); ok {
+				id.Groups = append(id.Groups, group)
+			}
+		}
+	}
+	return id, nil
+}
+
+// allowed is checked on every request, so narrowing the lists applies to
+// sessions that already exist.
+func (auth *oidcAuth) allowed(id identity) bool {
+	if len(auth.config.AllowedEmails) == 0 && len(auth.config.AllowedGroups) == 0 {
+		return true
+	}
+	email := strings.ToLower(id.Email)
+	for _, allowed := range auth.config.AllowedEmails {
+		allowed = strings.ToLower(allowed)
+		if len(email) > 0 && (email == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(email, allowed))) {
+			return true
+		}
+	}
+	for _, group := range id.Groups {
+		if slices.Contains(auth.config.AllowedGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// forward removes warptail's cookies from the request and passes the
+// identity to the backend. Identity headers sent by the client are always
+// dropped so the backend can trust them.
+func (auth *oidcAuth) forward(r *http.Request, id identity) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != sessionCookie && cookie.Name != stateCookie {
+			r.AddCookie(cookie)
+		}
+	}
+	for _, header := range []string{"X-Forwarded-User", "X-Forwarded-Email", "X-Forwarded-Groups"} {
+		r.Header.Del(header)
+	}
+	if !auth.config.ForwardHeaders {
+		return
+	}
+	r.Header.Set("X-Forwarded-User", id.user())
+	if len(id.Email) > 0 {
+		r.Header.Set("X-Forwarded-Email", id.Email)
+	}
+	if len(id.Groups) > 0 {
+		r.Header.Set("X-Forwarded-Groups", strings.Join(id.Groups, ","))
+	}
+}
+
+// provider discovers the provider's endpoints, failures are retried on the
+// next request. Discovery runs without holding mu, requests racing the first
+// one may discover it as well.
+func (auth *oidcAuth) provider(ctx context.Context) (*oidcProvider, error) {
+	auth.mu.Lock()
+	provider := auth.oidc
+	auth.mu.Unlock()
+	if provider != nil {
+		return provider, nil
+	}
+	provider, err := auth.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if auth.oidc == nil {
+		auth.oidc = provider
+	}
+	return auth.oidc, nil
+}
+
+func (auth *oidcAuth) discover(ctx context.Context) (*oidcProvider, error) {
+	url := strings.TrimSuffix(auth.config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := authHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery responded %s", resp.Status)
+	}
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("invalid discovery document: %v", err)
+	}
+	if discovery.Issuer != auth.config.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %s", discovery.Issuer)
+	}
+	if len(discovery.AuthorizationEndpoint) == 0 || len(discovery.TokenEndpoint) == 0 || len(discovery.JWKSURI) == 0 {
+		return nil, fmt.Errorf("discovery document is missing endpoints")
+	}
+	return &oidcProvider{
+		endpoint: oauth2.Endpoint{AuthURL: discovery.AuthorizationEndpoint, TokenURL: discovery.TokenEndpoint},
+		keys:     newJWKS(discovery.JWKSURI, DEFAULT_JWKS_TTL),
+	}, nil
+}
+
+func (auth *oidcAuth) oauth2(r *http.Request, provider *oidcProvider) *oauth2.Config {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &oauth2.Config{
+		ClientID:     auth.config.ClientID,
+		ClientSecret: auth.config.ClientSecret,
+		Endpoint:     provider.endpoint,
+		RedirectURL:  fmt.Sprintf("%s://%s%s", scheme, r.Host, OIDC_CALLBACK_PATH),
+		Scopes:       auth.config.Scopes,
+	}
+}
+
+// cookie is host only, so it is scoped to the route's domain.
+func (auth *oidcAuth) cookie(r *http.Request, name, path, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// encode serialises v and signs it with key, cookies are not encrypted.
+func (auth *oidcAuth) encode(key []byte, v any) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (auth *oidcAuth) decode(key []byte, value string, v any) error {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return errInvalidCookie
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return errInvalidCookie
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return errInvalidCookie
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return errInvalidCookie
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// localRedirect only lets the visitor return to a path on the same host.
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
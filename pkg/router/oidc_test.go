@@ -0,0 +1,342 @@
+package router
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"warptail/pkg/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockProvider is an OpenID Connect provider that signs in whoever it is
+// told to. Codes are handed out by the test instead of a login page.
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockLogin
+}
+
+// mockLogin is what the provider remembers about a code until it is
+// exchanged.
+type mockLogin struct {
+	challenge string
+	nonce     string
+	claims    jwt.MapClaims
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &mockProvider{key: key, codes: make(map[string]mockLogin)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.URL,
+			"authorization_endpoint": provider.URL + "/authorize",
+			"token_endpoint":         provider.URL + "/token",
+			"jwks_uri":               provider.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "test",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", provider.token)
+	provider.Server = httptest.NewServer(mux)
+	t.Cleanup(provider.Close)
+	return provider
+}
+
+// authorize plays the login page: it checks the redirect to the provider
+// and returns the code the visitor comes back with.
+func (provider *mockProvider) authorize(t *testing.T, location string, claims jwt.MapClaims) (code, state string) {
+	t.Helper()
+	redirect, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location, provider.URL+"/authorize?") {
+		t.Fatalf("redirected to %s, not the provider", location)
+	}
+	query := redirect.Query()
+	if query.Get("redirect_uri") != "http://app.test"+OIDC_CALLBACK_PATH {
+		t.Errorf("redirect_uri is %s", query.Get("redirect_uri"))
+	}
+	if query.Get("code_challenge_method") != "S256" || len(query.Get("code_challenge")) == 0 {
+		t.Errorf("sign in does not use PKCE: %s", location)
+	}
+	if len(query.Get("state")) == 0 || len(query.Get("nonce")) == 0 {
+		t.Errorf("sign in has no state or nonce: %s", location)
+	}
+	if !strings.Contains(query.Get("scope"), "openid") {
+		t.Errorf("scope %q lacks openid", query.Get("scope"))
+	}
+	code = randomString()
+	provider.mu.Lock()
+	provider.codes[code] = mockLogin{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), claims: claims}
+	provider.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func (provider *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	provider.mu.Lock()
+	login, ok := provider.codes[r.Form.Get("code")]
+	delete(provider.codes, r.Form.Get("code"))
+	provider.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != login.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	claims := jwt.MapClaims{
+		"iss":   provider.URL,
+		"aud":   "warptail",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": login.nonce,
+	}
+	for claim, value := range login.claims {
+		claims[claim] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(provider.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// oidcRequest runs a request through auth, cookies are the ones set by
+// earlier responses.
+func oidcRequest(auth *oidcAuth, target string, cookies []*http.Cookie) (*httptest.ResponseRecorder, string, bool) {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	user, ok := auth.authenticate(w, r)
+	return w, user, ok
+}
+
+// signIn goes through the redirect to the provider and back, it returns the
+// response to the callback.
+func signIn(t *testing.T, auth *oidcAuth, provider *mockProvider, claims jwt.MapClaims) *httptest.ResponseRecorder {
+	t.Helper()
+	w, _, ok := oidcRequest(auth, "http://app.test/private?page=1", nil)
+	if ok || w.Code != http.StatusFound {
+		t.Fatalf("visitor without a session got %d", w.Code)
+	}
+	code, state := provider.authorize(t, w.Header().Get("Location"), claims)
+	callback := "http://app.test" + OIDC_CALLBACK_PATH + "?" + url.Values{"code": {code}, "state": {state}}.Encode()
+	w, _, _ = oidcRequest(auth, callback, w.Result().Cookies())
+	return w
+}
+
+func sessionCookieOf(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookie && cookie.MaxAge > 0 {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	provider := newMockProvider(t)
+	auth, err := newOIDCAuth("app.test", utils.OIDCConfig{
+		Issuer:         provider.URL,
+		ClientID:       "warptail",
+		ClientSecret:   "secret",
+		ForwardHeaders: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := signIn(t, auth, provider, jwt.MapClaims{"sub": "1", "email": "ada@example.com", "groups": []string{"admins"}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/private?page=1" {
+		t.Fatalf("callback answered %d to %s", w.Code, w.Header().Get("Location"))
+	}
+	session := sessionCookieOf(w)
+	if session == nil || !session.HttpOnly {
+		t.Fatalf("callback set no http only session cookie")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://app.test/private", nil)
+	r.AddCookie(session)
+	r.AddCookie(&http.Cookie{Name: "app", Value: "kept"})
+	r.Header.Set("X-Forwarded-Email", "spoofed@example.com")
+	user, ok := auth.authenticate(httptest.NewRecorder(), r)
+	if !ok || user != "ada@example.com" {
+		t.Fatalf("session was not accepted, user %q", user)
+	}
+	if _, err := r.Cookie(sessionCookie); err == nil {
+		t.Errorf("session cookie is passed to the backend")
+	}
+	if cookie, err := r.Cookie("app"); err != nil || cookie.Value != "kept" {
+		t.Errorf("cookies of the backend were dropped")
+	}
+	if r.Header.Get("X-Forwarded-Email") != "ada@example.com" || r.Header.Get("X-Forwarded-Groups") != "admins" {
+		t.Errorf("identity headers are %v", r.Header)
+	}
+
+	// another identity under the signature of this session
+	tampered := *session
+	_, signature, _ := strings.Cut(session.Value, ".")
+	tampered.Value = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"2","exp":9999999999}`)) + "." + signature
+	if w, _, ok := oidcRequest(auth, "http://app.test/private", []*http.Cookie{&tampered}); ok || w.Code != http.StatusFound {
+		t.Errorf("tampered session got %d", w.Code)
+	}
+}
+
+func TestOIDCCallbackChecks(t *testing.T) {
+	provider := newMockProvider(t)
+	auth, err := newOIDCAuth("app.test", utils.OIDCConfig{Issuer: provider.URL, ClientID: "warptail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := func() (*httptest.ResponseRecorder, string, string) {
+		w, _, _ := oidcRequest(auth, "http://app.test/", nil)
+		code, state := provider.authorize(t, w.Header().Get("Location"), jwt.MapClaims{"sub": "1"})
+		return w, code, state
+	}
+	callback := func(code, state string) string {
+		return "http://app.test" + OIDC_CALLBACK_PATH + "?" + url.Values{"code": {code}, "state": {state}}.Encode()
+	}
+
+	// a state that does not match the cookie
+	login, code, _ := start()
+	if w, _, _ := oidcRequest(auth, callback(code, "forged"), login.Result().Cookies()); w.Code != http.StatusBadRequest || sessionCookieOf(w) != nil {
+		t.Errorf("forged state got %d", w.Code)
+	}
+
+	// no state cookie, the callback was not started by this browser
+	_, code, state := start()
+	if w, _, _ := oidcRequest(auth, callback(code, state), nil); w.Code != http.StatusBadRequest || sessionCookieOf(w) != nil {
+		t.Errorf("callback without state cookie got %d", w.Code)
+	}
+
+	// the state cookie of another sign in has a different PKCE verifier
+	other, _, _ := start()
+	_, code, state = start()
+	cookies := other.Result().Cookies()
+	var stolen loginState
+	auth.decode(auth.stateKey, cookies[0].Value, &stolen)
+	stolen.State = state
+	cookies[0].Value, _ = auth.encode(auth.stateKey, stolen)
+	if w, _, _ := oidcRequest(auth, callback(code, state), cookies); w.Code != http.StatusBadGateway || sessionCookieOf(w) != nil {
+		t.Errorf("wrong PKCE verifier got %d", w.Code)
+	}
+
+	// an id token for a different sign in carries another nonce
+	login, code, state = start()
+	provider.mu.Lock()
+	replayed := provider.codes[code]
+	replayed.nonce = "replayed"
+	provider.codes[code] = replayed
+	provider.mu.Unlock()
+	if w, _, _ := oidcRequest(auth, callback(code, state), login.Result().Cookies()); w.Code != http.StatusBadGateway || sessionCookieOf(w) != nil {
+		t.Errorf("wrong nonce got %d", w.Code)
+	}
+}
+
+// TestOIDCStateAsSession checks the state cookie of a sign in that was only
+// started does not pass as a session.
+func TestOIDCStateAsSession(t *testing.T) {
+	provider := newMockProvider(t)
+	auth, err := newOIDCAuth("app.test", utils.OIDCConfig{Issuer: provider.URL, ClientID: "warptail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login, _, _ := oidcRequest(auth, "http://app.test/", nil)
+	var state *http.Cookie
+	for _, cookie := range login.Result().Cookies() {
+		if cookie.Name == stateCookie {
+			state = cookie
+		}
+	}
+	if state == nil {
+		t.Fatalf("sign in set no state cookie")
+	}
+	forged := &http.Cookie{Name: sessionCookie, Value: state.Value}
+	if w, user, ok := oidcRequest(auth, "http://app.test/private", []*http.Cookie{forged}); ok || w.Code != http.StatusFound {
+		t.Errorf("state cookie as session got %d for user %q", w.Code, user)
+	}
+
+	// a session without a subject is not anyone
+	value, err := auth.encode(auth.sessionKey, identity{Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous := &http.Cookie{Name: sessionCookie, Value: value}
+	if w, _, ok := oidcRequest(auth, "http://app.test/private", []*http.Cookie{anonymous}); ok || w.Code != http.StatusFound {
+		t.Errorf("session without a subject got %d", w.Code)
+	}
+}
+
+func TestOIDCRestrictions(t *testing.T) {
+	provider := newMockProvider(t)
+	auth, err := newOIDCAuth("app.test", utils.OIDCConfig{
+		Issuer:        provider.URL,
+		ClientID:      "warptail",
+		AllowedEmails: []string{"@example.com"},
+		AllowedGroups: []string{"admins"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		claims  jwt.MapClaims
+		allowed bool
+	}{
+		{"allowed domain", jwt.MapClaims{"sub": "1", "email": "ada@EXAMPLE.com"}, true},
+		{"other domain", jwt.MapClaims{"sub": "2", "email": "eve@example.org"}, false},
+		{"suffix of the domain", jwt.MapClaims{"sub": "3", "email": "eve@notexample.com"}, false},
+		{"unverified email", jwt.MapClaims{"sub": "4", "email": "eve@example.com", "email_verified": false}, false},
+		{"allowed group", jwt.MapClaims{"sub": "5", "email": "bob@example.org", "groups": []string{"users", "admins"}}, true},
+		{"other group", jwt.MapClaims{"sub": "6", "groups": "users"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := signIn(t, auth, provider, test.claims)
+			if test.allowed && (w.Code != http.StatusFound || sessionCookieOf(w) == nil) {
+				t.Errorf("sign in got %d", w.Code)
+			}
+			if !test.allowed && (w.Code != http.StatusForbidden || sessionCookieOf(w) != nil) {
+				t.Errorf("sign in got %d", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package router
+
+import (
+	"sync"
+	"time"
+	"warptail/pkg/utils"
+)
+
+const (
+	DEFAULT_DIAL_TIMEOUT            = 10 * time.Second
+	DEFAULT_RESPONSE_HEADER_TIMEOUT = 60 * time.Second
+	DEFAULT_BASE_EJECTION_TIME      = 30 * time.Second
+	DEFAULT_MAX_EJECTION_TIME       = 5 * time.Minute
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker ejects a backend after too many consecutive failures. Once
+// the ejection time is over a single probe is let through (half-open); its
+// success closes the circuit again while a failure ejects the backend for
+// twice as long, up to the max ejection time.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     circuitState
+	failures  int
+	ejections int
+	openUntil time.Time
+}
+
+// available reports whether the breaker would let traffic through without
+// changing its state.
+func (cb *circuitBreaker) available() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		return time.Now().After(cb.openUntil)
+	case circuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// allow claims the breaker for a connection or request. An expired open
+// breaker moves to half-open and only the first caller gets the probe.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if time.Now().Before(cb.openUntil) {
+			return false
+		}
+		cb.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// success closes the breaker. Results that come in while it is open are
+// from traffic sent before the ejection and are ignored, only the half-open
+// probe decides.
+func (cb *circuitBreaker) success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == circuitOpen {
+		return
+	}
+	cb.state = circuitClosed
+	cb.failures = 0
+	cb.ejections = 0
+}
+
+// failure records a failed attempt, returning true when the backend got
+// ejected by it. Like success it is ignored while the breaker is open.
+func (cb *circuitBreaker) failure(config utils.OutlierDetectionConfig) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == circuitOpen {
+		return false
+	}
+	cb.failures++
+	if cb.state == circuitClosed && (config.ConsecutiveFailures <= 0 || cb.failures < config.ConsecutiveFailures) {
+		return false
+	}
+	ejection := duration(config.BaseEjectionTime, DEFAULT_BASE_EJECTION_TIME) << cb.ejections
+	if max := duration(config.MaxEjectionTime, DEFAULT_MAX_EJECTION_TIME); ejection > max || ejection <= 0 {
+		ejection = max
+	} else {
+		cb.ejections++
+	}
+	cb.state = circuitOpen
+	cb.openUntil = time.Now().Add(ejection)
+	return true
+}
+
+// cancel gives back a half-open probe that ended without a verdict, for
+// example because the client went away.
+func (cb *circuitBreaker) cancel() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == circuitHalfOpen {
+		cb.state = circuitOpen
+	}
+}
+
+func (cb *circuitBreaker) ejectedUntil() (time.Time, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.openUntil, cb.state != circuitClosed
+}
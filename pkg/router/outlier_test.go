@@ -0,0 +1,65 @@
+package router
+
+import (
+	"testing"
+	"time"
+	"warptail/pkg/utils"
+)
+
+// TestCircuitBreaker checks only the half-open probe decides about an
+// ejected backend, results of requests still in flight are ignored.
+func TestCircuitBreaker(t *testing.T) {
+	config := utils.OutlierDetectionConfig{
+		ConsecutiveFailures: 2,
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionTime:     time.Hour,
+	}
+	var cb circuitBreaker
+	if cb.failure(config) {
+		t.Fatalf("ejected after a single failure")
+	}
+	if !cb.failure(config) {
+		t.Fatalf("not ejected after %d failures", config.ConsecutiveFailures)
+	}
+	until, _ := cb.ejectedUntil()
+
+	// requests that were sent before the ejection
+	for i := 0; i < 10; i++ {
+		if cb.failure(config) {
+			t.Fatalf("ejected again by a request in flight")
+		}
+	}
+	if again, ejected := cb.ejectedUntil(); !ejected || !again.Equal(until) {
+		t.Fatalf("requests in flight moved the ejection to %s", again)
+	}
+	cb.success()
+	if cb.available() {
+		t.Fatalf("a request in flight closed the breaker")
+	}
+
+	// the probe fails, the next ejection is twice as long
+	cb.mu.Lock()
+	cb.openUntil = time.Now()
+	cb.mu.Unlock()
+	if !cb.allow() || cb.allow() {
+		t.Fatalf("expired breaker did not hand out a single probe")
+	}
+	if !cb.failure(config) {
+		t.Fatalf("failed probe did not eject the backend")
+	}
+	if until, _ := cb.ejectedUntil(); time.Until(until) < time.Minute+30*time.Second {
+		t.Fatalf("second ejection ends at %s, it is not backed off", until)
+	}
+
+	// the probe succeeds
+	cb.mu.Lock()
+	cb.openUntil = time.Now()
+	cb.mu.Unlock()
+	if !cb.allow() {
+		t.Fatalf("expired breaker did not hand out a probe")
+	}
+	cb.success()
+	if _, ejected := cb.ejectedUntil(); ejected || !cb.available() {
+		t.Fatalf("successful probe did not close the breaker")
+	}
+}
@@ -0,0 +1,66 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"warptail/pkg/utils"
+)
+
+type pathMatcher struct {
+	rule  utils.PathRule
+	regex *regexp.Regexp
+	pool  *BackendPool
+}
+
+// newPathMatchers compiles the path rules of a route, reusing the backends
+// of previous matchers so their stats survive an update.
+func newPathMatchers(rules []utils.PathRule, previous []pathMatcher) ([]pathMatcher, error) {
+	matchers := make([]pathMatcher, 0, len(rules))
+	for i, rule := range rules {
+		var pool *BackendPool
+		if i < len(previous) {
+			pool = previous[i].pool
+		}
+		matcher := pathMatcher{
+			rule: rule,
+			pool: NewBackendPool(utils.RoundRobin, []utils.Machine{rule.Machine}, pool),
+		}
+		switch rule.Match {
+		case "", utils.PathPrefix, utils.PathExact:
+		case utils.PathRegex:
+			regex, err := regexp.Compile(rule.Path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path regex %q: %v", rule.Path, err)
+			}
+			matcher.regex = regex
+		default:
+			return nil, fmt.Errorf("unknown path match %q", rule.Match)
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
+
+// Match reports whether path is selected by the rule. Prefixes match whole
+// path elements so "/api" matches "/api" and "/api/users" but not "/apis".
+func (matcher pathMatcher) Match(path string) bool {
+	switch matcher.rule.Match {
+	case utils.PathExact:
+		return path == matcher.rule.Path
+	case utils.PathRegex:
+		return matcher.regex.MatchString(path)
+	default:
+		prefix := strings.TrimSuffix(matcher.rule.Path, "/")
+		return path == prefix || strings.HasPrefix(path, prefix+"/")
+	}
+}
+
+func matchPath(matchers []pathMatcher, path string) (*pathMatcher, bool) {
+	for i := range matchers {
+		if matchers[i].Match(path) {
+			return &matchers[i], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,132 @@
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"warptail/pkg/utils"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyHeaderKey struct{}
+
+// checkProxyProtocol rejects PROXY protocol versions the route type cannot
+// send, v1 has no way to describe udp.
+func checkProxyProtocol(config utils.RouteConfig) error {
+	switch config.ProxyProtocol {
+	case "", utils.ProxyProtocolV2:
+		return nil
+	case utils.ProxyProtocolV1:
+		if config.Type == utils.UDP {
+			return fmt.Errorf("udp routes only support proxy protocol v2")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown proxy protocol version %s", config.ProxyProtocol)
+	}
+}
+
+// proxyHeader builds the PROXY protocol header of a connection from src to
+// dst, udp is only set for datagrams. When either address is unknown the
+// header says so and the backend uses the connection's own addresses.
+func proxyHeader(version utils.ProxyProtocol, udp bool, src, dst netip.AddrPort) []byte {
+	srcAddr, dstAddr := src.Addr().Unmap(), dst.Addr().Unmap()
+	if srcAddr.Is4() && dstAddr.Is6() && dstAddr.IsUnspecified() {
+		// a dual stack listener, the client came in over IPv4
+		dstAddr = netip.IPv4Unspecified()
+	}
+	known := src.IsValid() && dst.IsValid() && srcAddr.Is4() == dstAddr.Is4()
+	if version == utils.ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if srcAddr.Is4() {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcAddr, dstAddr, src.Port(), dst.Port()))
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	if !known {
+		// LOCAL command, no addresses
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+	family := byte(0x20)
+	if srcAddr.Is4() {
+		family = 0x10
+	}
+	transport := byte(0x01)
+	if udp {
+		transport = 0x02
+	}
+	addresses := append(srcAddr.AsSlice(), dstAddr.AsSlice()...)
+	addresses = binary.BigEndian.AppendUint16(addresses, src.Port())
+	addresses = binary.BigEndian.AppendUint16(addresses, dst.Port())
+	header = append(header, 0x21, family|transport)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+// WithProxyHeader writes header to every connection before anything else,
+// including a TLS handshake layered on top.
+func (dial Dialer) WithProxyHeader(header []byte) Dialer {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(header); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to send proxy header to %s: %v", address, err)
+		}
+		return conn, nil
+	}
+}
+
+// withContextProxyHeader sends the header stored in the dial context by
+// withProxyHeader. Dials without one, such as health checks, send a header
+// without addresses.
+func (dial Dialer) withContextProxyHeader(version utils.ProxyProtocol) Dialer {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		header, ok := ctx.Value(proxyHeaderKey{}).([]byte)
+		if !ok {
+			header = proxyHeader(version, false, netip.AddrPort{}, netip.AddrPort{})
+		}
+		return dial.WithProxyHeader(header)(ctx, network, address)
+	}
+}
+
+// withProxyHeader stores the PROXY header of the client of r for the
+// connection to the backend.
+func withProxyHeader(r *http.Request, version utils.ProxyProtocol) *http.Request {
+	var src, dst netip.AddrPort
+	if ip, err := netip.ParseAddr(clientIP(r)); err == nil {
+		// the port is only known when the client connected directly
+		port := uint16(0)
+		if remote, err := netip.ParseAddrPort(r.RemoteAddr); err == nil && remote.Addr().Unmap() == ip.Unmap() {
+			port = remote.Port()
+		}
+		src = netip.AddrPortFrom(ip, port)
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		dst, _ = netip.ParseAddrPort(local.String())
+	}
+	header := proxyHeader(version, false, src, dst)
+	return r.WithContext(context.WithValue(r.Context(), proxyHeaderKey{}, header))
+}
+
+// addrPort converts a tcp or udp address for proxyHeader.
+func addrPort(addr net.Addr) netip.AddrPort {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.AddrPort()
+	case *net.UDPAddr:
+		return addr.AddrPort()
+	}
+	return netip.AddrPort{}
+}
@@ -0,0 +1,144 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+	"warptail/pkg/utils"
+
+	"golang.org/x/time/rate"
+)
+
+var ErrConnectionRate = errors.New("route is over its new connection rate")
+
+// clientLimiterIdle is how long the bucket of a client is kept after its
+// last request. A bucket idle for longer is full again anyway.
+const clientLimiterIdle = 5 * time.Minute
+
+// minShapingBurst keeps reads of shaped connections from being chopped
+// into tiny pieces at low rates.
+const minShapingBurst = 32 * 1024
+
+func burst(config utils.RateLimitConfig, perSecond float64) int {
+	if config.Burst > 0 {
+		return config.Burst
+	}
+	return int(math.Max(1, math.Ceil(perSecond)))
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// clientLimiters keeps a token bucket per client IP.
+type clientLimiters struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+// newClientLimiters returns nil when perSecond is not set, a nil
+// clientLimiters lets everything through.
+func newClientLimiters(perSecond float64, burst int) *clientLimiters {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &clientLimiters{
+		limit:     rate.Limit(perSecond),
+		burst:     burst,
+		clients:   make(map[string]*clientLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// reserve takes a token for ip. When none is left it returns how long the
+// client should wait before trying again.
+func (limiters *clientLimiters) reserve(ip string) (time.Duration, bool) {
+	if limiters == nil {
+		return 0, true
+	}
+	limiters.mu.Lock()
+	defer limiters.mu.Unlock()
+	now := time.Now()
+	if now.Sub(limiters.lastSweep) > clientLimiterIdle {
+		for key, client := range limiters.clients {
+			if now.Sub(client.lastSeen) > clientLimiterIdle {
+				delete(limiters.clients, key)
+			}
+		}
+		limiters.lastSweep = now
+	}
+	client, ok := limiters.clients[ip]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(limiters.limit, limiters.burst)}
+		limiters.clients[ip] = client
+	}
+	client.lastSeen = now
+	reservation := client.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay, false
+	}
+	return 0, true
+}
+
+// routeRateLimits are the token buckets of a single run of a route.
+type routeRateLimits struct {
+	requests    *clientLimiters
+	connections *rate.Limiter
+	sent        *rate.Limiter
+	received    *rate.Limiter
+}
+
+func newRouteRateLimits(config utils.RateLimitConfig) *routeRateLimits {
+	limits := &routeRateLimits{
+		requests: newClientLimiters(config.RequestsPerSecond, burst(config, config.RequestsPerSecond)),
+	}
+	if config.ConnectionsPerSecond > 0 {
+		limits.connections = rate.NewLimiter(rate.Limit(config.ConnectionsPerSecond), burst(config, config.ConnectionsPerSecond))
+	}
+	if config.BytesPerSecond > 0 {
+		bytesBurst := int(math.Max(float64(config.BytesPerSecond), minShapingBurst))
+		limits.sent = rate.NewLimiter(rate.Limit(config.BytesPerSecond), bytesBurst)
+		limits.received = rate.NewLimiter(rate.Limit(config.BytesPerSecond), bytesBurst)
+	}
+	return limits
+}
+
+func (limits *routeRateLimits) allowConnection() bool {
+	return limits.connections == nil || limits.connections.Allow()
+}
+
+// shapedReader holds reads back to the rate of limiter.
+type shapedReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+// shape limits how fast r can be read, nil limiters leave it as is.
+func shape(ctx context.Context, r io.ReadCloser, limiter *rate.Limiter) io.ReadCloser {
+	if limiter == nil {
+		return r
+	}
+	return &shapedReader{ReadCloser: r, ctx: ctx, limiter: limiter}
+}
+
+func (reader *shapedReader) Read(p []byte) (int, error) {
+	if burst := reader.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := reader.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := reader.limiter.WaitN(reader.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
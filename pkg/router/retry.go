@@ -0,0 +1,122 @@
+package router
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"warptail/pkg/utils"
+)
+
+const DEFAULT_RETRY_BODY_SIZE = 64 * 1024
+
+var defaultRetryOn = []string{"connect-failure", "gateway-error"}
+
+var errPerTryTimeout = errors.New("backend did not respond within the per try timeout")
+
+// dialError marks a failure to connect to a backend, the request never
+// reached it.
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string { return e.err.Error() }
+func (e *dialError) Unwrap() error { return e.err }
+
+// retryStatusError is returned from ModifyResponse to drop a response that
+// will be retried.
+type retryStatusError struct {
+	status string
+}
+
+func (e *retryStatusError) Error() string { return "retrying after " + e.status }
+
+func retryOn(policy utils.RetryPolicy) []string {
+	if len(policy.RetryOn) > 0 {
+		return policy.RetryOn
+	}
+	return defaultRetryOn
+}
+
+func retryableStatus(policy utils.RetryPolicy, status int) bool {
+	for _, condition := range retryOn(policy) {
+		switch condition {
+		case "5xx":
+			if status >= http.StatusInternalServerError {
+				return true
+			}
+		case "gateway-error":
+			if status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout {
+				return true
+			}
+		default:
+			if code, err := strconv.Atoi(condition); err == nil && code == status {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func retryableError(policy utils.RetryPolicy, err error) bool {
+	var dialErr *dialError
+	var netErr net.Error
+	timeout := errors.Is(err, errPerTryTimeout) || (errors.As(err, &netErr) && netErr.Timeout())
+	for _, condition := range retryOn(policy) {
+		switch condition {
+		case "connect-failure":
+			if errors.As(err, &dialErr) {
+				return true
+			}
+		case "timeout":
+			if timeout {
+				return true
+			}
+		case "reset":
+			if !timeout && !errors.As(err, &dialErr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// idempotent follows net/http in what it considers safe to send twice.
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != "" || r.Header.Get("X-Idempotency-Key") != ""
+}
+
+// bufferBody reads the request body into memory so it can be replayed for
+// every attempt. It returns false when the body is larger than max, in which
+// case the request is left as if it had not been touched.
+func bufferBody(r *http.Request, max int64) (func(), bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return func() {}, true
+	}
+	if r.ContentLength > max {
+		return nil, false
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil || int64(len(buf)) > max {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	rewind := func() {
+		r.Body = io.NopCloser(bytes.NewReader(buf))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(buf)), nil
+		}
+	}
+	rewind()
+	return rewind, true
+}
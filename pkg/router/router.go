@@ -1,13 +1,22 @@
 package router
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net/http"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 	"warptail/pkg/kubeController"
+	"warptail/pkg/logging"
 	"warptail/pkg/utils"
 
 	"github.com/google/uuid"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"tailscale.com/tsnet"
 )
 
@@ -20,6 +29,10 @@ const (
 	STOPPED  = RouterStatus("Stopped")
 )
 
+// DEFAULT_ACCESS_LOG_SIZE is how many access log entries each route keeps
+// in memory.
+const DEFAULT_ACCESS_LOG_SIZE = 1000
+
 type Route interface {
 	Start() error
 	Stop() error
@@ -27,24 +40,49 @@ type Route interface {
 	Config() utils.RouteConfig
 	Status() RouterStatus
 	Stats() utils.TimeSeriesData
+	Traffic(time.Time) utils.ProxyStats
+	Backends() []BackendInfo
+	Counters() RouteCounters
+	AccessLog() *utils.AccessLog
 }
 
+// Router owns the routes. The route table is guarded by mu so proxied
+// requests can look up routes while the API changes them.
 type Router struct {
+	mu     sync.RWMutex
 	routes map[string]Route
+	names  map[string][]string
+	saveMu sync.Mutex
 	ts     *tsnet.Server
 	ctrl   *kubeController.K8Controller
-	wg     sync.WaitGroup
+	certs  *CertStore
+	acme   *autocert.Manager
+	logger *logging.Logger
+	events *EventBus
+	quit   chan bool
+
+	acmeHandler    http.Handler
+	trustedProxies prefixList
+	geo            *GeoIP
+	wg             sync.WaitGroup
 }
 
 type RouteInfo struct {
 	utils.RouteConfig
-	Status RouterStatus
-	Stats  utils.TimeSeriesData
+	Status       RouterStatus
+	Healthy      bool
+	Stats        utils.TimeSeriesData
+	Counters     RouteCounters
+	BackendStats []BackendInfo
 }
 
 func NewRouter(config utils.Config) (*Router, error) {
 	router := &Router{
 		routes: make(map[string]Route),
+		names:  make(map[string][]string),
+		certs:  NewCertStore(),
+		events: NewEventBus(),
+		quit:   make(chan bool),
 		wg:     sync.WaitGroup{},
 	}
 
@@ -56,61 +94,303 @@ func NewRouter(config utils.Config) (*Router, error) {
 		}
 	}
 
+	if config.TLS.ACME.Enabled {
+		var err error
+		router.acme, err = newACMEManager(config.TLS.ACME, router.hostPolicy)
+		if err != nil {
+			log.Fatalf("ACME Error: %v", err)
+		}
+		router.acmeHandler = router.acme.HTTPHandler(nil)
+	}
+
+	if len(config.Logging.Sinks) > 0 {
+		var err error
+		router.logger, err = logging.NewLogger(config.Logging)
+		if err != nil {
+			log.Fatalf("Access Log Error: %v", err)
+		}
+	}
+
+	var err error
+	router.trustedProxies, err = parsePrefixes(config.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Trusted Proxies Error: %v", err)
+	}
+	router.geo, err = NewGeoIP(config.GeoIP)
+	if err != nil {
+		log.Fatalf("GeoIP Error: %v", err)
+	}
+
 	router.UpdateTailScale(config.Tailscale)
 	for _, route := range config.Routes {
 		router.AddRoute(route)
 	}
 	router.StartAll()
+	go router.monitorEvents(router.quit)
 	return router, nil
 }
 
 func (r *Router) UpdateTailScale(config utils.TailscaleConfig) {
 	if r.ts != nil {
-		r.Close()
+		r.StopAll()
+		r.ts.Close()
 	}
-	r.ts = new(tsnet.Server)
-	r.ts.AuthKey = config.AuthKey
-	r.ts.Hostname = config.Hostname
+	ts := new(tsnet.Server)
+	ts.AuthKey = config.AuthKey
+	ts.Hostname = config.Hostname
+	r.mu.Lock()
+	r.ts = ts
+	r.mu.Unlock()
 }
 
 func (r *Router) Close() {
+	close(r.quit)
 	r.StopAll()
 	r.ts.Close()
+	if r.logger != nil {
+		r.logger.Close()
+	}
+	r.geo.Close()
 }
 
-func (r *Router) AddRoute(config utils.RouteConfig) (Route, error) {
-	defer r.save()
-	if len(config.Id) == 0 {
-		config.Id = uuid.NewString()
+// Events is the bus route changes, status and health changes and traffic
+// are published on.
+func (r *Router) Events() *EventBus {
+	return r.events
+}
+
+// TLSConfig returns the configuration for the TLS listener, picking the
+// certificate of the https route matching the requested server name. Names
+// without a configured certificate are served from ACME when enabled.
+func (r *Router) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     r.getCertificate,
+		GetConfigForClient: r.getConfigForClient,
+	}
+	if r.acme != nil {
+		config.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+	return config
+}
+
+// getConfigForClient asks for a client certificate when the https route
+// of the requested server name requires one. Rejected handshakes are
+// counted by the route.
+func (r *Router) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if isACMEChallenge(hello) {
+		return nil, nil
+	}
+	route, err := r.GetRouteByName(strings.TrimSuffix(hello.ServerName, "."))
+	if err != nil {
+		return nil, nil
+	}
+	https, ok := route.(*HTTPSRoute)
+	if !ok {
+		return nil, nil
+	}
+	clients := https.clientVerifier()
+	if clients == nil {
+		return nil, nil
+	}
+	config := r.TLSConfig()
+	config.GetConfigForClient = nil
+	config.ClientAuth = tls.RequestClientCert
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if err := clients.verify(state.PeerCertificates); err != nil {
+			https.counters.certRejected.Add(1)
+			log.Printf("client certificate of %s for %s rejected: %v", hello.Conn.RemoteAddr(), hello.ServerName, err)
+			return err
+		}
+		return nil
+	}
+	return config, nil
+}
+
+func (r *Router) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if r.acme == nil {
+		return r.certs.GetCertificate(hello)
+	}
+	if !isACMEChallenge(hello) {
+		if cert, ok := r.certs.Lookup(hello.ServerName); ok {
+			return cert, nil
+		}
+	}
+	return r.acme.GetCertificate(hello)
+}
+
+// ACMEHandler answers ACME http-01 challenges, it is nil when ACME is not
+// enabled.
+func (r *Router) ACMEHandler() http.Handler {
+	return r.acmeHandler
+}
+
+func (r *Router) hostPolicy(_ context.Context, host string) error {
+	route, err := r.GetRouteByName(host)
+	if err != nil {
+		return fmt.Errorf("acme: host %s is not routed", host)
+	}
+	if t := route.Config().Type; t != utils.HTTP && t != utils.HTTPS {
+		return fmt.Errorf("acme: route %s is not an http route", host)
+	}
+	return nil
+}
+
+// obtainCertificate requests the ACME certificate of an http route up front
+// rather than on the first handshake. autocert renews it from then on.
+func (r *Router) obtainCertificate(config utils.RouteConfig) {
+	if r.acme == nil || (config.Type != utils.HTTP && config.Type != utils.HTTPS) {
+		return
+	}
+	if _, ok := r.certs.Lookup(config.Name); ok {
+		return
+	}
+	// autocert hands out RSA certificates unless the hello shows the client
+	// can do ECDSA, which any current client can
+	hello := &tls.ClientHelloInfo{
+		ServerName:        config.Name,
+		CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+	}
+	if _, err := r.acme.GetCertificate(hello); err != nil {
+		log.Printf("ACME certificate for %s failed: %v", config.Name, err)
 	}
-	client, _ := r.ts.LocalClient()
+}
+
+// newRoute builds the route for a config, it must be called with mu held.
+func (r *Router) newRoute(config utils.RouteConfig) (Route, error) {
+	var route Route
 	switch config.Type {
 	case utils.UDP:
-		r.routes[config.Id] = NewNetworkRoute(config, client)
+		route = NewUDPRoute(config, r.ts, r.geo, r.events)
 	case utils.TCP:
-		r.routes[config.Id] = NewNetworkRoute(config, client)
+		client, _ := r.ts.LocalClient()
+		route = NewNetworkRoute(config, client, r.geo, r.events)
 	case utils.HTTP:
-		r.routes[config.Id] = NewHTTPRoute(config, r.ts)
+		route = NewHTTPRoute(config, r.ts, r.geo, r.events)
+	case utils.HTTPS:
+		route = NewHTTPSRoute(config, r.ts, r.certs, r.geo, r.events)
 	default:
 		return nil, fmt.Errorf("no handler for type %s", config.Type)
 	}
-	return r.routes[config.Id], nil
+	if r.logger != nil {
+		route.AccessLog().SetSink(r.logger)
+	}
+	return route, nil
+}
+
+func (r *Router) AddRoute(config utils.RouteConfig) (Route, error) {
+	if len(config.Id) == 0 {
+		config.Id = uuid.NewString()
+	}
+	r.mu.Lock()
+	route, err := r.newRoute(config)
+	if err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	previous, replaced := r.routes[config.Id]
+	if replaced {
+		r.releaseName(previous.Config().Name, config.Id)
+	}
+	r.routes[config.Id] = route
+	r.claimName(config.Name, config.Id)
+	r.mu.Unlock()
+	if replaced {
+		previous.Stop()
+	}
+	r.save()
+	r.events.Publish(Event{Type: RouteAddedEvent, Route: config.Id, Name: config.Name, Config: &config})
+	return route, nil
 }
 
-func (r *Router) UpdateRoute(route utils.RouteConfig) {
-	defer r.save()
-	r.DeleteRoute(route.Id)
-	r.AddRoute(route)
-	r.StopRoute(route.Id)
+// UpdateRoute applies a new config to an existing route. The route is
+// updated in place so it keeps its stats and running state, only a change of
+// type replaces it. Disabling a route stops it.
+func (r *Router) UpdateRoute(config utils.RouteConfig) error {
+	r.mu.Lock()
+	route, ok := r.routes[config.Id]
+	if !ok {
+		r.mu.Unlock()
+		return fmt.Errorf("route %s not found", config.Id)
+	}
+	previous := route.Config()
+	replacement := route
+	if previous.Type != config.Type {
+		var err error
+		if replacement, err = r.newRoute(config); err != nil {
+			r.mu.Unlock()
+			return err
+		}
+		r.routes[config.Id] = replacement
+	}
+	r.releaseName(previous.Name, config.Id)
+	r.claimName(config.Name, config.Id)
+	r.mu.Unlock()
+
+	var err error
+	if replacement == route {
+		// the route keeps its previous config when the new one is refused
+		if err = route.Update(config); err != nil {
+			r.mu.Lock()
+			if _, ok := r.routes[config.Id]; ok && previous.Name != config.Name {
+				r.releaseName(config.Name, config.Id)
+				r.claimName(previous.Name, config.Id)
+			}
+			r.mu.Unlock()
+			return err
+		}
+	} else if route.Status() == RUNNING {
+		route.Stop()
+		err = replacement.Start()
+	} else {
+		route.Stop()
+	}
+	if !config.Enabled {
+		replacement.Stop()
+	}
+	r.save()
+	r.events.Publish(Event{Type: RouteUpdatedEvent, Route: config.Id, Name: config.Name, Config: &config})
+	return err
 }
 
 func (r *Router) DeleteRoute(Id string) {
-	defer r.save()
-	r.StopRoute(Id)
-	delete(r.routes, Id)
+	r.mu.Lock()
+	route, ok := r.routes[Id]
+	if ok {
+		delete(r.routes, Id)
+		r.releaseName(route.Config().Name, Id)
+	}
+	r.mu.Unlock()
+	if ok {
+		route.Stop()
+		r.events.Publish(Event{Type: RouteDeletedEvent, Route: Id, Name: route.Config().Name})
+	}
+	r.save()
+}
+
+// claimName makes route id the one found by name. Other routes of the same
+// name are remembered and get it back when id lets go. Both must be called
+// with mu held.
+func (r *Router) claimName(name, id string) {
+	r.releaseName(name, id)
+	r.names[name] = append(r.names[name], id)
+}
+
+func (r *Router) releaseName(name, id string) {
+	ids := slices.DeleteFunc(r.names[name], func(owner string) bool { return owner == id })
+	if len(ids) == 0 {
+		delete(r.names, name)
+		return
+	}
+	r.names[name] = ids
 }
 
 func (r *Router) GetRoute(Id string) Route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	if route, ok := r.routes[Id]; ok {
 		return route
 	}
@@ -118,17 +398,33 @@ func (r *Router) GetRoute(Id string) Route {
 }
 
 func (r *Router) GetRouteByName(name string) (Route, error) {
-	for _, route := range r.routes {
-		if route.Config().Name == name {
-			return route, nil
-		}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if ids := r.names[name]; len(ids) > 0 {
+		return r.routes[ids[len(ids)-1]], nil
 	}
 	return nil, fmt.Errorf("no route found")
 }
 
+// list returns the routes at the time of the call, so they can be walked
+// without holding mu.
+func (r *Router) list() []Route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	routes := make([]Route, 0, len(r.routes))
+	for _, route := range r.routes {
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// save persists the routes. saveMu makes sure the last change is also the
+// last one written.
 func (r *Router) save() {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
 	routes := []utils.RouteConfig{}
-	for _, route := range r.routes {
+	for _, route := range r.list() {
 		routes = append(routes, route.Config())
 	}
 	if r.ctrl != nil {
@@ -138,51 +434,77 @@ func (r *Router) save() {
 }
 
 func (r *Router) Get(name string) (RouteInfo, error) {
-	if route, ok := r.routes[name]; ok {
-		return RouteInfo{
-			RouteConfig: route.Config(),
-			Status:      route.Status(),
-			Stats:       route.Stats(),
-		}, nil
+	if route := r.GetRoute(name); route != nil {
+		return routeInfo(route), nil
 	}
 	return RouteInfo{}, fmt.Errorf("route %s not found", name)
 }
 
 func (r *Router) GetAll() []RouteInfo {
 	routes := []RouteInfo{}
-	for key := range r.routes {
-		r, _ := r.Get(key)
-		routes = append(routes, r)
+	for _, route := range r.list() {
+		routes = append(routes, routeInfo(route))
 	}
 	return routes
 }
 
+func routeInfo(route Route) RouteInfo {
+	info := RouteInfo{
+		RouteConfig:  route.Config(),
+		Status:       route.Status(),
+		Stats:        route.Stats(),
+		Counters:     route.Counters(),
+		BackendStats: route.Backends(),
+	}
+	for _, backend := range info.BackendStats {
+		info.Healthy = info.Healthy || backend.Healthy
+	}
+	return info
+}
+
 func (r *Router) StartRoute(name string) {
-	if !r.routes[name].Config().Enabled {
+	if route := r.GetRoute(name); route != nil {
+		r.start(route)
+	}
+}
+
+func (r *Router) start(route Route) {
+	if !route.Config().Enabled {
 		return
 	}
 	r.wg.Add(1)
 	go func() {
 		defer r.wg.Done()
-		err := r.routes[name].Start()
+		err := route.Start()
 		if err != nil {
 			log.Println(err)
+			return
 		}
+		r.obtainCertificate(route.Config())
 	}()
 }
 
 func (r *Router) StartAll() {
-	for name := range r.routes {
-		r.StartRoute(name)
+	for _, route := range r.list() {
+		r.start(route)
 	}
 }
 
 func (r *Router) StopRoute(Id string) {
-	r.routes[Id].Stop()
+	if route := r.GetRoute(Id); route != nil {
+		route.Stop()
+	}
 }
 
+// StopAll stops every route, draining them in parallel.
 func (r *Router) StopAll() {
-	for name := range r.routes {
-		r.StopRoute(name)
+	var wg sync.WaitGroup
+	for _, route := range r.list() {
+		wg.Add(1)
+		go func(route Route) {
+			defer wg.Done()
+			route.Stop()
+		}(route)
 	}
+	wg.Wait()
 }
@@ -0,0 +1,293 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"warptail/pkg/utils"
+)
+
+// newTestRouter builds a router without a tailnet, its config is saved to a
+// temporary directory.
+func newTestRouter(t *testing.T) *Router {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("routes: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return &Router{
+		routes: make(map[string]Route),
+		names:  make(map[string][]string),
+		certs:  NewCertStore(),
+		events: NewEventBus(),
+		quit:   make(chan bool),
+	}
+}
+
+// testMachine points a route at a local test server.
+func testMachine(t *testing.T, server *httptest.Server) utils.Machine {
+	t.Helper()
+	address, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.ParseUint(address.Port(), 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return utils.Machine{Address: address.Hostname(), Port: uint16(port)}
+}
+
+// addTestRoute adds an http route that reaches its backends over the local
+// network instead of the tailnet and starts it.
+func addTestRoute(r *Router, config utils.RouteConfig) (Route, error) {
+	route, err := r.AddRoute(config)
+	if err != nil {
+		return nil, err
+	}
+	httpRoute := route.(*HTTPRoute)
+	httpRoute.lock.Lock()
+	httpRoute.dial = (&net.Dialer{}).DialContext
+	httpRoute.lock.Unlock()
+	return route, route.Start()
+}
+
+func serveTestRequest(r *Router, name string) int {
+	route, err := r.GetRouteByName(name)
+	if err != nil {
+		return http.StatusNotFound
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://"+name+"/", nil)
+	w := httptest.NewRecorder()
+	route.(*HTTPRoute).Handle(w, req)
+	return w.Code
+}
+
+// TestRouterStress changes routes while requests flow through them, run it
+// with -race.
+func TestRouterStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+	r := newTestRouter(t)
+	machines := []utils.Machine{}
+	for i := 0; i < 2; i++ {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		defer backend.Close()
+		machines = append(machines, testMachine(t, backend))
+	}
+
+	stable, err := addTestRoute(r, utils.RouteConfig{
+		Enabled: true,
+		Name:    "stable.test",
+		Type:    utils.HTTP,
+		Machine: machines[0],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.StopAll()
+
+	// routes change until the traffic is done
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var traffic, wg sync.WaitGroup
+	var served atomic.Uint64
+
+	// traffic to a route that is only ever updated in place must not fail
+	for i := 0; i < 8; i++ {
+		traffic.Add(1)
+		go func() {
+			defer traffic.Done()
+			for j := 0; j < 50; j++ {
+				if code := serveTestRequest(r, "stable.test"); code != http.StatusOK {
+					t.Errorf("stable route answered %d", code)
+					return
+				}
+				served.Add(1)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ctx.Err() == nil; i++ {
+			config := stable.Config()
+			config.Machine = machines[i%len(machines)]
+			if err := r.UpdateRoute(config); err != nil {
+				t.Errorf("updating stable route failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	// routes that come and go, sharing names with each other
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("churn-%d.test", i%2)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				serveTestRequest(r, name)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; ctx.Err() == nil; j++ {
+				route, err := addTestRoute(r, utils.RouteConfig{
+					Enabled: true,
+					Name:    name,
+					Type:    utils.HTTP,
+					Machine: machines[j%len(machines)],
+				})
+				if err != nil {
+					t.Errorf("adding %s failed: %v", name, err)
+					return
+				}
+				config := route.Config()
+				config.Machine = machines[(j+1)%len(machines)]
+				if err := r.UpdateRoute(config); err != nil {
+					t.Errorf("updating %s failed: %v", name, err)
+					return
+				}
+				r.GetAll()
+				r.DeleteRoute(config.Id)
+			}
+		}()
+	}
+	traffic.Wait()
+	cancel()
+	wg.Wait()
+
+	if served.Load() != 8*50 {
+		t.Fatalf("stable route served %d of %d requests", served.Load(), 8*50)
+	}
+	for _, name := range []string{"churn-0.test", "churn-1.test"} {
+		if _, err := r.GetRouteByName(name); err == nil {
+			t.Errorf("%s is still routed after all its routes were deleted", name)
+		}
+	}
+	if len(r.names) != 1 {
+		t.Errorf("names holds %d entries, want 1", len(r.names))
+	}
+}
+
+// TestRouteNames checks a route keeps its name when another route of the
+// same name goes away.
+func TestRouteNames(t *testing.T) {
+	r := newTestRouter(t)
+	first, err := r.AddRoute(utils.RouteConfig{Name: "shared.test", Type: utils.HTTP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.AddRoute(utils.RouteConfig{Name: "shared.test", Type: utils.HTTP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route, _ := r.GetRouteByName("shared.test"); route != second {
+		t.Fatalf("shared.test is not routed to the route added last")
+	}
+
+	config := second.Config()
+	config.Name = "renamed.test"
+	if err := r.UpdateRoute(config); err != nil {
+		t.Fatal(err)
+	}
+	if route, _ := r.GetRouteByName("shared.test"); route != first {
+		t.Fatalf("shared.test did not go back to the first route after a rename")
+	}
+	r.DeleteRoute(config.Id)
+	if route, _ := r.GetRouteByName("shared.test"); route != first {
+		t.Fatalf("deleting another route took the name of the first one")
+	}
+	r.DeleteRoute(first.Config().Id)
+	if _, err := r.GetRouteByName("shared.test"); err == nil {
+		t.Fatalf("shared.test is still routed after its routes were deleted")
+	}
+}
+
+// TestRefusedUpdate checks a running route keeps serving its config when an
+// update does not validate.
+func TestRefusedUpdate(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	machine := testMachine(t, backend)
+	routes := map[utils.RouteType]Route{
+		utils.HTTP:  NewHTTPRoute(utils.RouteConfig{Name: "app.test", Type: utils.HTTP, Machine: machine}, nil, nil, nil),
+		utils.HTTPS: NewHTTPSRoute(utils.RouteConfig{Name: "app.test", Type: utils.HTTPS, Machine: machine}, nil, NewCertStore(), nil, nil),
+		utils.TCP:   NewNetworkRoute(utils.RouteConfig{Name: "app.test", Type: utils.TCP, Machine: machine}, nil, nil, nil),
+		utils.UDP:   NewUDPRoute(utils.RouteConfig{Name: "app.test", Type: utils.UDP, Machine: machine}, nil, nil, nil),
+	}
+	refused := map[string]func(*utils.RouteConfig){
+		"bad cidr":       func(config *utils.RouteConfig) { config.Access.Deny = []string{"10.0.0.0/33"} },
+		"proxy protocol": func(config *utils.RouteConfig) { config.ProxyProtocol = "v3" },
+		"backend scheme": func(config *utils.RouteConfig) { config.Machine.Scheme = "ftp" },
+	}
+	for routeType, route := range routes {
+		if err := route.Start(); err != nil {
+			t.Fatalf("%s route did not start: %v", routeType, err)
+		}
+		defer route.Stop()
+		for name, change := range refused {
+			config := route.Config()
+			change(&config)
+			if err := route.Update(config); err == nil {
+				t.Errorf("%s route took a config with a %s", routeType, name)
+			}
+			if route.Status() != RUNNING || route.Config().Machine != machine {
+				t.Errorf("%s route is %s after a refused update with a %s", routeType, route.Status(), name)
+			}
+		}
+	}
+
+	config := routes[utils.HTTPS].Config()
+	config.TLS.CertFile = "missing.pem"
+	config.TLS.KeyFile = "missing.key"
+	if err := routes[utils.HTTPS].Update(config); err == nil {
+		t.Errorf("https route took a certificate that does not exist")
+	}
+	if routes[utils.HTTPS].Status() != RUNNING || len(routes[utils.HTTPS].Config().TLS.CertFile) > 0 {
+		t.Errorf("https route is %s after a refused certificate", routes[utils.HTTPS].Status())
+	}
+}
+
+// TestPathOnlyRoute checks a route that only has path rules has no backend
+// of its own.
+func TestPathOnlyRoute(t *testing.T) {
+	route := NewHTTPRoute(utils.RouteConfig{
+		Name: "paths.test",
+		Type: utils.HTTP,
+		Paths: []utils.PathRule{
+			{Path: "/api", Machine: utils.Machine{Address: "127.0.0.1", Port: 8080}},
+		},
+	}, nil, nil, nil)
+	if err := route.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer route.Stop()
+	backends := route.Backends()
+	if len(backends) != 1 || backends[0].Address != "127.0.0.1" {
+		t.Errorf("backends are %v", backends)
+	}
+}
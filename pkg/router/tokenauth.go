@@ -0,0 +1,245 @@
+package router
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"warptail/pkg/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	DEFAULT_USER_CLAIM     = "sub"
+	DEFAULT_API_KEY_HEADER = "X-API-Key"
+)
+
+var hmacAlgorithms = []string{"HS256", "HS384", "HS512"}
+
+// tokenAuth checks the credentials of machine clients, a bearer JWT and/or
+// an API key. Unlike basicAuth it never asks for credentials, a request
+// without valid ones is simply refused.
+type tokenAuth struct {
+	parser    *jwt.Parser
+	jwks      *jwks
+	static    jwt.VerificationKeySet
+	issuer    string
+	audience  []string
+	claims    map[string]string
+	userClaim string
+
+	header  string
+	apiKeys map[[sha256.Size]byte]string
+}
+
+func newTokenAuth(jwtConfig utils.JWTAuthConfig, keyConfig utils.APIKeyAuthConfig) (*tokenAuth, error) {
+	auth := &tokenAuth{
+		issuer:    jwtConfig.Issuer,
+		audience:  jwtConfig.Audience,
+		claims:    jwtConfig.RequiredClaims,
+		userClaim: jwtConfig.UserClaim,
+		header:    keyConfig.Header,
+	}
+	if len(auth.userClaim) == 0 {
+		auth.userClaim = DEFAULT_USER_CLAIM
+	}
+	if len(auth.header) == 0 {
+		auth.header = DEFAULT_API_KEY_HEADER
+	}
+
+	if len(jwtConfig.JWKSURL) > 0 {
+		auth.jwks = newJWKS(jwtConfig.JWKSURL, jwtConfig.JWKSCacheDuration)
+	}
+	for _, path := range jwtConfig.KeyFiles {
+		keys, err := loadVerificationKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		auth.static.Keys = append(auth.static.Keys, keys...)
+	}
+	methods := []string{}
+	if auth.jwks != nil || len(auth.static.Keys) > 0 {
+		methods = append(methods, jwtAlgorithms...)
+	}
+	if len(jwtConfig.Secret) > 0 {
+		auth.static.Keys = append(auth.static.Keys, []byte(jwtConfig.Secret))
+		methods = append(methods, hmacAlgorithms...)
+	}
+	if len(methods) > 0 {
+		options := []jwt.ParserOption{
+			jwt.WithValidMethods(methods),
+			jwt.WithExpirationRequired(),
+			jwt.WithLeeway(jwtConfig.Leeway),
+		}
+		if len(auth.issuer) > 0 {
+			options = append(options, jwt.WithIssuer(auth.issuer))
+		}
+		auth.parser = jwt.NewParser(options...)
+	}
+
+	if len(keyConfig.Keys) > 0 {
+		auth.apiKeys = make(map[[sha256.Size]byte]string)
+		for name, hash := range keyConfig.Keys {
+			sum, err := hex.DecodeString(hash)
+			if err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("api key %s is not a hex encoded sha256 hash", name)
+			}
+			auth.apiKeys[[sha256.Size]byte(sum)] = name
+		}
+	}
+	return auth, nil
+}
+
+func (auth *tokenAuth) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if key := r.Header.Get(auth.header); auth.apiKeys != nil && len(key) > 0 {
+		name, ok := auth.apiKeys[sha256.Sum256([]byte(key))]
+		if !ok {
+			auth.deny(w, "invalid api key")
+			return "", false
+		}
+		// the key is for warptail, not the backend
+		r.Header.Del(auth.header)
+		return name, true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if auth.parser == nil || !ok {
+		auth.deny(w, "")
+		return "", false
+	}
+	user, err := auth.verify(strings.TrimSpace(token))
+	if err != nil {
+		auth.deny(w, err.Error())
+		return "", false
+	}
+	return user, true
+}
+
+// deny refuses a request, reason is empty when no credentials were sent.
+func (auth *tokenAuth) deny(w http.ResponseWriter, reason string) {
+	if auth.parser != nil {
+		challenge := fmt.Sprintf("Bearer realm=%q", DEFAULT_AUTH_REALM)
+		if len(reason) > 0 {
+			challenge += `, error="invalid_token"`
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	if len(reason) == 0 {
+		reason = "credentials required"
+	}
+	errorPage(w, http.StatusUnauthorized, reason)
+}
+
+func (auth *tokenAuth) verify(raw string) (string, error) {
+	claims := jwt.MapClaims{}
+	if _, err := auth.parser.ParseWithClaims(raw, claims, auth.keyfunc); err != nil {
+		return "", err
+	}
+	if len(auth.audience) > 0 {
+		audience, _ := claims.GetAudience()
+		if !slices.ContainsFunc(audience, func(aud string) bool { return slices.Contains(auth.audience, aud) }) {
+			return "", fmt.Errorf("token is not for this audience")
+		}
+	}
+	for claim, want := range auth.claims {
+		if !claimContains(claims[claim], want) {
+			return "", fmt.Errorf("token claim %s does not match", claim)
+		}
+	}
+	user, _ := claims[auth.userClaim].(string)
+	return user, nil
+}
+
+// keyfunc tries the key set of the jwks url first and falls back to the
+// static keys. A token without a key id gets the only key of the set, so
+// the static keys are tried after it as well.
+func (auth *tokenAuth) keyfunc(token *jwt.Token) (interface{}, error) {
+	if auth.jwks != nil {
+		key, err := auth.jwks.Keyfunc(token)
+		if len(auth.static.Keys) == 0 {
+			return key, err
+		}
+		if err == nil {
+			return jwt.VerificationKeySet{Keys: append([]jwt.VerificationKey{key}, auth.static.Keys...)}, nil
+		}
+	}
+	return auth.static, nil
+}
+
+// claimContains matches a claim against a required value. Lists match when
+// they contain the value and strings when they equal it or, like the scope
+// claim, hold it as one of their space separated words.
+func claimContains(claim interface{}, want string) bool {
+	switch value := claim.(type) {
+	case nil:
+		return false
+	case string:
+		return value == want || slices.Contains(strings.Fields(value), want)
+	case []interface{}:
+		for _, item := range value {
+			if claimContains(item, want) {
+				return true
+			}
+		}
+		return false
+	default:
+		return fmt.Sprint(value) == want
+	}
+}
+
+// loadVerificationKeys reads the public keys of a PEM file or a JWKS
+// document.
+func loadVerificationKeys(path string) ([]jwt.VerificationKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key file: %v", err)
+	}
+	keys := []jwt.VerificationKey{}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var set struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		if err := json.Unmarshal(data, &set); err != nil {
+			return nil, fmt.Errorf("%s: invalid jwks: %v", path, err)
+		}
+		for _, jwk := range set.Keys {
+			key, err := jwk.publicKey()
+			if err != nil {
+				return nil, fmt.Errorf("%s: key %s: %v", path, jwk.Kid, err)
+			}
+			keys = append(keys, key)
+		}
+	} else {
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			var key interface{}
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err = x509.ParsePKIXPublicKey(block.Bytes)
+			case "RSA PUBLIC KEY":
+				key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+			case "CERTIFICATE":
+				var cert *x509.Certificate
+				if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+					key = cert.PublicKey
+				}
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no public keys", path)
+	}
+	return keys, nil
+}
@@ -0,0 +1,246 @@
+package router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"warptail/pkg/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockJWKS serves the public keys it is given and counts how often the set
+// is fetched.
+type mockJWKS struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    []jsonWebKey
+	fetches int
+}
+
+func newMockJWKS(t *testing.T) *mockJWKS {
+	t.Helper()
+	set := &mockJWKS{}
+	set.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		set.mu.Lock()
+		defer set.mu.Unlock()
+		set.fetches++
+		json.NewEncoder(w).Encode(map[string]any{"keys": set.keys})
+	}))
+	t.Cleanup(set.Close)
+	return set
+}
+
+func (set *mockJWKS) publish(kid string, key *ecdsa.PrivateKey) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.keys = append(set.keys, jsonWebKey{
+		Kty: "EC",
+		Kid: kid,
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	})
+}
+
+func (set *mockJWKS) fetched() int {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return set.fetches
+}
+
+func newECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writeKeyFile saves the public key of key as PEM for key_files.
+func writeKeyFile(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if len(kid) > 0 {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func bearerRequest(auth *tokenAuth, token string) (*httptest.ResponseRecorder, string, bool) {
+	r := httptest.NewRequest(http.MethodGet, "http://api.test/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	user, ok := auth.authenticate(w, r)
+	return w, user, ok
+}
+
+func TestTokenAuth(t *testing.T) {
+	set := newMockJWKS(t)
+	signer := newECKey(t)
+	set.publish("1", signer)
+	fileKey := newECKey(t)
+	auth, err := newTokenAuth(utils.JWTAuthConfig{
+		JWKSURL:        set.URL,
+		KeyFiles:       []string{writeKeyFile(t, fileKey)},
+		Issuer:         "https://issuer.test",
+		Audience:       []string{"api.test"},
+		RequiredClaims: map[string]string{"scope": "write"},
+	}, utils.APIKeyAuthConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub":   "ci",
+			"iss":   "https://issuer.test",
+			"aud":   "api.test",
+			"scope": "read write",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	with := func(key string, value any) jwt.MapClaims {
+		claims := valid()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+	tests := []struct {
+		name    string
+		token   string
+		allowed bool
+	}{
+		{"valid", signToken(t, jwt.SigningMethodES256, "1", signer, valid()), true},
+		{"key file", signToken(t, jwt.SigningMethodES256, "", fileKey, valid()), true},
+		{"scope list", signToken(t, jwt.SigningMethodES256, "1", signer, with("scope", []string{"read", "write"})), true},
+		{"hmac without secret", signToken(t, jwt.SigningMethodHS256, "1", []byte("guess"), valid()), false},
+		{"none", signToken(t, jwt.SigningMethodNone, "1", jwt.UnsafeAllowNoneSignatureType, valid()), false},
+		{"unknown key", signToken(t, jwt.SigningMethodES256, "1", newECKey(t), valid()), false},
+		{"wrong audience", signToken(t, jwt.SigningMethodES256, "1", signer, with("aud", "other.test")), false},
+		{"wrong issuer", signToken(t, jwt.SigningMethodES256, "1", signer, with("iss", "https://other.test")), false},
+		{"expired", signToken(t, jwt.SigningMethodES256, "1", signer, with("exp", time.Now().Add(-time.Minute).Unix())), false},
+		{"no expiry", signToken(t, jwt.SigningMethodES256, "1", signer, with("exp", nil)), false},
+		{"missing scope", signToken(t, jwt.SigningMethodES256, "1", signer, with("scope", "read writer")), false},
+		{"no scope", signToken(t, jwt.SigningMethodES256, "1", signer, with("scope", nil)), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, user, ok := bearerRequest(auth, test.token)
+			if ok != test.allowed {
+				t.Fatalf("token allowed %v, want %v", ok, test.allowed)
+			}
+			if ok && user != "ci" {
+				t.Errorf("user is %q", user)
+			}
+			if !ok && (w.Code != http.StatusUnauthorized || len(w.Header().Get("WWW-Authenticate")) == 0) {
+				t.Errorf("refused token got %d %v", w.Code, w.Header())
+			}
+		})
+	}
+}
+
+// TestTokenAuthKeyRotation checks a token of a key the provider just
+// published is accepted once the key set is fetched again.
+func TestTokenAuthKeyRotation(t *testing.T) {
+	set := newMockJWKS(t)
+	set.publish("1", newECKey(t))
+	auth, err := newTokenAuth(utils.JWTAuthConfig{JWKSURL: set.URL}, utils.APIKeyAuthConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := newECKey(t)
+	token := signToken(t, jwt.SigningMethodES256, "2", rotated, jwt.MapClaims{"sub": "ci", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, _, ok := bearerRequest(auth, token); ok {
+		t.Fatalf("token of an unpublished key was accepted")
+	}
+	set.publish("2", rotated)
+
+	// unknown key ids only refetch the set once a minute
+	if _, _, ok := bearerRequest(auth, token); ok || set.fetched() != 1 {
+		t.Fatalf("key set was fetched %d times", set.fetched())
+	}
+	auth.jwks.mu.Lock()
+	auth.jwks.refreshed = time.Now().Add(-jwksMinRefresh)
+	auth.jwks.mu.Unlock()
+	if _, user, ok := bearerRequest(auth, token); !ok || user != "ci" || set.fetched() != 2 {
+		t.Fatalf("token of a rotated key got user %q after %d fetches", user, set.fetched())
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	sum := sha256.Sum256([]byte("secret-key"))
+	auth, err := newTokenAuth(utils.JWTAuthConfig{}, utils.APIKeyAuthConfig{
+		Keys: map[string]string{"ci": hex.EncodeToString(sum[:])},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		key  string
+		user string
+	}{
+		{"valid", "secret-key", "ci"},
+		{"wrong key", "secret-kez", ""},
+		{"prefix of the key", "secret", ""},
+		{"no key", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://api.test/", nil)
+			if len(test.key) > 0 {
+				r.Header.Set(DEFAULT_API_KEY_HEADER, test.key)
+			}
+			w := httptest.NewRecorder()
+			user, ok := auth.authenticate(w, r)
+			if ok != (len(test.user) > 0) || user != test.user {
+				t.Fatalf("got user %q, allowed %v", user, ok)
+			}
+			if ok && len(r.Header.Get(DEFAULT_API_KEY_HEADER)) > 0 {
+				t.Errorf("api key is passed to the backend")
+			}
+			if !ok && w.Code != http.StatusUnauthorized {
+				t.Errorf("refused key got %d", w.Code)
+			}
+		})
+	}
+
+	if _, err := newTokenAuth(utils.JWTAuthConfig{}, utils.APIKeyAuthConfig{Keys: map[string]string{"ci": "secret-key"}}); err == nil {
+		t.Errorf("a plain key was taken as a hash")
+	}
+}
@@ -0,0 +1,573 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"warptail/pkg/utils"
+
+	"tailscale.com/tsnet"
+)
+
+// DEFAULT_UDP_IDLE_TIMEOUT is how long a client session is kept open without
+// any traffic in either direction before the tailnet conn is torn down.
+const DEFAULT_UDP_IDLE_TIMEOUT = 60 * time.Second
+
+const udpBufferSize = 0xffff
+
+// udpPendingLimit is how many datagrams of a new client are held while its
+// tailnet conn is dialed, later ones are dropped.
+const udpPendingLimit = 64
+
+type udpSession struct {
+	client *net.UDPAddr
+	proxy  net.Conn
+	// run is the config the session was opened with
+	run *udpRun
+	// packet starts with the PROXY header sent ahead of every datagram
+	packet   []byte
+	header   int
+	backend  *Backend
+	release  func()
+	opened   time.Time
+	sent     atomic.Uint64
+	received atomic.Uint64
+	mu       sync.Mutex
+	lastSeen time.Time
+	// pending holds the datagrams received while proxy is dialed
+	pending [][]byte
+	dialed  bool
+}
+
+// queue holds payload until the session is dialed, it reports false once
+// the session can be written to directly.
+func (session *udpSession) queue(payload []byte) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.dialed {
+		return false
+	}
+	if len(session.pending) < udpPendingLimit {
+		session.pending = append(session.pending, append([]byte(nil), payload...))
+	}
+	return true
+}
+
+// datagram prefixes payload with the PROXY header of the session, it is
+// only called from the route's read loop.
+func (session *udpSession) datagram(payload []byte) []byte {
+	if session.header == 0 {
+		return payload
+	}
+	return append(session.packet[:session.header], payload...)
+}
+
+func (session *udpSession) touch() {
+	session.mu.Lock()
+	session.lastSeen = time.Now()
+	session.mu.Unlock()
+}
+
+func (session *udpSession) idle() bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return time.Since(session.lastSeen) > session.run.idleTimeout()
+}
+
+type UDPRoute struct {
+	lock     sync.RWMutex
+	config   utils.RouteConfig
+	status   RouterStatus
+	dial     Dialer
+	data     *utils.TimeSeries
+	pool     *BackendPool
+	counters routeCounters
+	logs     *utils.AccessLog
+	geo      *GeoIP
+	events   *EventBus
+	current  *udpListener
+}
+
+// udpRun is the config new client sessions of a UDPRoute are opened with
+// between two updates. Its sessions are drained once the route moves on.
+type udpRun struct {
+	*drainer
+	config utils.RouteConfig
+	pool   *BackendPool
+	access *accessList
+}
+
+func (run *udpRun) idleTimeout() time.Duration {
+	return duration(run.config.IdleTimeout, DEFAULT_UDP_IDLE_TIMEOUT)
+}
+
+// udpListener serves the port of a UDPRoute. The socket carries the
+// datagrams of every session, so an update that keeps the port only swaps
+// the run new clients get while the sessions of the previous one drain.
+type udpListener struct {
+	conn     *net.UDPConn
+	mu       sync.Mutex
+	run      *udpRun
+	sessions map[string]*udpSession
+	// draining counts the runs whose sessions are not closed yet
+	draining sync.WaitGroup
+	handlers sync.WaitGroup
+	quit     chan bool
+	exited   chan bool
+}
+
+func NewUDPRoute(config utils.RouteConfig, server *tsnet.Server, geo *GeoIP, events *EventBus) *UDPRoute {
+	return &UDPRoute{
+		config: config,
+		data:   utils.NewTimeSeries(time.Second, 1000),
+		logs:   utils.NewAccessLog(DEFAULT_ACCESS_LOG_SIZE),
+		status: STOPPED,
+		dial:   server.Dial,
+		geo:    geo,
+		events: events,
+		pool:   NewBackendPool(config.LoadBalancer, config.Machines(), nil),
+	}
+}
+
+// setStatus changes the status of the route and publishes the change, it
+// must be called with lock held.
+func (route *UDPRoute) setStatus(status RouterStatus) {
+	if route.status != status {
+		route.status = status
+		route.events.routeStatus(route.config, status)
+	}
+}
+
+func (route *UDPRoute) Status() RouterStatus {
+	route.lock.RLock()
+	defer route.lock.RUnlock()
+	return route.status
+}
+
+func (route *UDPRoute) Config() utils.RouteConfig {
+	route.lock.RLock()
+	defer route.lock.RUnlock()
+	return route.config
+}
+
+func (route *UDPRoute) Stats() utils.TimeSeriesData {
+	return route.data.Snapshot()
+}
+
+func (route *UDPRoute) Traffic(t time.Time) utils.ProxyStats {
+	return route.data.At(t)
+}
+
+// log adds entry to the access log tagged with the client's country and
+// counts it in the per country stats.
+func (route *UDPRoute) log(entry utils.AccessLogEntry) {
+	entry.Country = route.geo.Country(entry.ClientIP)
+	route.counters.record(entry)
+	route.logs.Add(entry)
+}
+
+func (route *UDPRoute) AccessLog() *utils.AccessLog {
+	return route.logs
+}
+
+func (route *UDPRoute) Counters() RouteCounters {
+	return route.counters.Snapshot()
+}
+
+func (route *UDPRoute) Backends() []BackendInfo {
+	route.lock.RLock()
+	defer route.lock.RUnlock()
+	return route.pool.Info()
+}
+
+// Update applies a new config to a running route. When the port stays the
+// same new clients get the new config right away while the sessions of the
+// previous one are drained, otherwise the old port is drained in the
+// background. A config that does not validate leaves the route running as
+// it was.
+func (route *UDPRoute) Update(config utils.RouteConfig) error {
+	route.lock.Lock()
+	defer route.lock.Unlock()
+	pool := NewBackendPool(config.LoadBalancer, config.Machines(), route.pool)
+	current := route.current
+	if route.status != RUNNING || current == nil {
+		route.config = config
+		route.pool = pool
+		return nil
+	}
+	run, err := route.newRun(config, pool)
+	if err != nil {
+		return err
+	}
+	previous := route.config
+	route.config = config
+	route.pool = pool
+	if previous.Port != config.Port {
+		route.stop()
+		go route.close(current)
+		return route.listen(run)
+	}
+	current.mu.Lock()
+	old := current.run
+	current.run = run
+	current.mu.Unlock()
+	old.pool.StopHealthChecks()
+	route.use(current, run)
+	current.draining.Add(1)
+	go func() {
+		defer current.draining.Done()
+		old.drain(duration(old.config.DrainTimeout, DEFAULT_DRAIN_TIMEOUT))
+	}()
+	return nil
+}
+
+// Stop stops taking new clients and waits for the open sessions to go idle,
+// closing them after the drain timeout.
+func (route *UDPRoute) Stop() error {
+	route.lock.Lock()
+	current := route.stop()
+	route.lock.Unlock()
+	if current == nil {
+		return nil
+	}
+	route.close(current)
+	route.lock.Lock()
+	if route.status == STOPPING {
+		route.setStatus(STOPPED)
+	}
+	route.lock.Unlock()
+	return nil
+}
+
+// stop detaches the listener of the route and returns it so its sessions
+// can be drained, or nil when the route is not running.
+func (route *UDPRoute) stop() *udpListener {
+	current := route.current
+	if route.status != RUNNING || current == nil {
+		return nil
+	}
+	route.setStatus(STOPPING)
+	route.current = nil
+	return current
+}
+
+// close drains every session of l and closes its socket once they are
+// gone.
+func (route *UDPRoute) close(l *udpListener) {
+	l.mu.Lock()
+	run := l.run
+	l.run = nil
+	l.mu.Unlock()
+	if run != nil {
+		run.pool.StopHealthChecks()
+		run.drain(duration(run.config.DrainTimeout, DEFAULT_DRAIN_TIMEOUT))
+	}
+	l.draining.Wait()
+	close(l.quit)
+	l.conn.Close()
+	<-l.exited
+}
+
+func (route *UDPRoute) Start() error {
+	route.lock.Lock()
+	defer route.lock.Unlock()
+	if route.status == RUNNING {
+		return nil
+	}
+	return route.start()
+}
+
+// newRun checks config and builds the run new sessions are opened with.
+func (route *UDPRoute) newRun(config utils.RouteConfig, pool *BackendPool) (*udpRun, error) {
+	access, err := newAccessList(config.Access, route.geo)
+	if err != nil {
+		return nil, err
+	}
+	// udp backends are never reached over tls, this only checks the schemes
+	if _, err := loadBackendTLS(config.Type, config.Machines()); err != nil {
+		return nil, err
+	}
+	if err := checkProxyProtocol(config); err != nil {
+		return nil, err
+	}
+	return &udpRun{
+		drainer: newDrainer(),
+		config:  config,
+		pool:    pool,
+		access:  access,
+	}, nil
+}
+
+// use starts the health checks of a run that takes new clients on l and
+// makes sure its sessions are closed at the end of its drain.
+func (route *UDPRoute) use(l *udpListener, run *udpRun) {
+	run.pool.StartHealthChecks(run.config.HealthCheck, route.dial, route.events.healthChanges(run.config))
+	context.AfterFunc(run.ctx, func() {
+		route.closeSessions(l, func(session *udpSession) bool { return session.run == run })
+	})
+}
+
+func (route *UDPRoute) start() error {
+	route.setStatus(STARTING)
+	run, err := route.newRun(route.config, route.pool)
+	if err != nil {
+		route.setStatus(STOPPED)
+		return err
+	}
+	return route.listen(run)
+}
+
+// listen opens the port of run and serves it.
+func (route *UDPRoute) listen(run *udpRun) error {
+	laddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", run.config.Port))
+	if err != nil {
+		route.setStatus(STOPPED)
+		return err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		route.setStatus(STOPPED)
+		return err
+	}
+	route.current = &udpListener{
+		conn:     conn,
+		run:      run,
+		sessions: make(map[string]*udpSession),
+		quit:     make(chan bool),
+		exited:   make(chan bool),
+	}
+	route.use(route.current, run)
+	go route.serve(route.current)
+	route.setStatus(RUNNING)
+	return nil
+}
+
+// sweepInterval is how often idle sessions are looked for, a fraction of
+// the idle timeout so they do not outlive it by much.
+func (l *udpListener) sweepInterval() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.run == nil {
+		return time.Second
+	}
+	return min(max(l.run.idleTimeout()/4, 10*time.Millisecond), time.Second)
+}
+
+func (route *UDPRoute) serve(l *udpListener) {
+	l.handlers.Add(1)
+	go func() {
+		defer l.handlers.Done()
+		route.sweep(l)
+	}()
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.quit:
+				// every run is drained by now, this only catches stragglers
+				route.closeSessions(l, func(*udpSession) bool { return true })
+				l.handlers.Wait()
+				close(l.exited)
+				return
+			default:
+			}
+			log.Printf("udp read failed: %v", err)
+			continue
+		}
+		session, err := route.session(l, addr)
+		if errors.Is(err, ErrRouteLimit) || errors.Is(err, ErrClientLimit) || errors.Is(err, ErrAccessDenied) || errors.Is(err, errRouteStopped) {
+			// dropped, the client will retry or give up
+			continue
+		} else if err != nil {
+			log.Printf("remote connection failed: %v", err)
+			continue
+		}
+		session.touch()
+		if !session.queue(buf[:n]) {
+			route.forward(session, buf[:n])
+		}
+	}
+}
+
+// sweep closes idle sessions until l is closed. It runs on its own so
+// traffic of other clients cannot keep idle sessions open.
+func (route *UDPRoute) sweep(l *udpListener) {
+	for {
+		select {
+		case <-l.quit:
+			return
+		case <-time.After(l.sweepInterval()):
+			route.closeSessions(l, (*udpSession).idle)
+		}
+	}
+}
+
+// forward sends a datagram of the client to the backend of its session.
+func (route *UDPRoute) forward(session *udpSession, payload []byte) {
+	if _, err := session.proxy.Write(session.datagram(payload)); err != nil {
+		log.Printf("udp write to %s failed: %v", session.backend.Machine, err)
+		return
+	}
+	n := uint64(len(payload))
+	route.data.LogRecived(n)
+	session.backend.data.LogRecived(n)
+	session.received.Add(n)
+}
+
+// session returns the session for a client address. Sessions of clients we
+// have not seen before are dialed in the background, their datagrams are
+// queued until the tailnet conn is up.
+func (route *UDPRoute) session(l *udpListener, addr *net.UDPAddr) (*udpSession, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if session, ok := l.sessions[addr.String()]; ok {
+		return session, nil
+	}
+	run := l.run
+	if run == nil {
+		// the route is stopping, only known clients are served
+		return nil, errRouteStopped
+	}
+	if !route.counters.allowed(run.access, addr.IP.String()) {
+		return nil, ErrAccessDenied
+	}
+	limit, err := route.counters.acquire(addr.IP.String(), run.config.Limits)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := run.pool.Next(addr.IP.String())
+	if err != nil {
+		limit()
+		return nil, err
+	}
+	release := backend.Acquire()
+	run.active.Add(1)
+	session := &udpSession{
+		client:  addr,
+		run:     run,
+		backend: backend,
+		release: func() {
+			release()
+			limit()
+			run.active.Done()
+		},
+		opened:   time.Now(),
+		lastSeen: time.Now(),
+	}
+	if version := run.config.ProxyProtocol; len(version) > 0 {
+		header := proxyHeader(version, true, addr.AddrPort(), addrPort(l.conn.LocalAddr()))
+		session.packet = append(make([]byte, 0, len(header)+udpBufferSize), header...)
+		session.header = len(header)
+	}
+	l.sessions[addr.String()] = session
+	l.handlers.Add(1)
+	go func() {
+		defer l.handlers.Done()
+		if route.connect(l, session) {
+			route.reply(l, session)
+		}
+	}()
+	return session, nil
+}
+
+// connect dials the backend of a new session and sends the datagrams queued
+// in the meantime. It reports false when the session did not get a conn.
+func (route *UDPRoute) connect(l *udpListener, session *udpSession) bool {
+	key := session.client.String()
+	config := session.run.config
+	// a tsnet conn keeps datagram boundaries, the LocalAPI dial of
+	// tcp routes is a byte stream
+	dial := route.dial.WithTimeout(duration(config.DialTimeout, DEFAULT_DIAL_TIMEOUT))
+	proxy, err := dial(session.run.ctx, string(utils.UDP), session.backend.Machine.String())
+	session.backend.Report(err, config.OutlierDetection)
+	l.mu.Lock()
+	current := l.sessions[key] == session
+	if err != nil || !current {
+		if current {
+			delete(l.sessions, key)
+			session.release()
+		}
+		l.mu.Unlock()
+		if err != nil {
+			entry := route.sessionLog(session, utils.CloseEvent)
+			entry.Error = err.Error()
+			route.log(entry)
+		} else {
+			// closed while it was dialed
+			proxy.Close()
+		}
+		return false
+	}
+	session.proxy = proxy
+	route.counters.requests.Add(1)
+	l.mu.Unlock()
+	route.log(route.sessionLog(session, utils.OpenEvent))
+
+	session.mu.Lock()
+	for _, payload := range session.pending {
+		route.forward(session, payload)
+	}
+	session.pending = nil
+	session.dialed = true
+	session.mu.Unlock()
+	return true
+}
+
+// reply copies datagrams from the tailnet conn back to the client until the
+// session is closed.
+func (route *UDPRoute) reply(l *udpListener, session *udpSession) {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, err := session.proxy.Read(buf)
+		if err != nil {
+			return
+		}
+		session.touch()
+		if _, err := l.conn.WriteToUDP(buf[:n], session.client); err != nil {
+			return
+		}
+		route.data.LogSent(uint64(n))
+		session.backend.data.LogSent(uint64(n))
+		session.sent.Add(uint64(n))
+	}
+}
+
+func (route *UDPRoute) closeSessions(l *udpListener, expired func(*udpSession) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, session := range l.sessions {
+		if expired(session) {
+			session.release()
+			delete(l.sessions, key)
+			if session.proxy == nil {
+				// still dialing, connect closes the conn when it gets one
+				continue
+			}
+			session.proxy.Close()
+			route.log(route.sessionLog(session, utils.CloseEvent))
+		}
+	}
+}
+
+func (route *UDPRoute) sessionLog(session *udpSession, event utils.AccessLogEvent) utils.AccessLogEntry {
+	entry := utils.AccessLogEntry{
+		Time:     time.Now(),
+		Route:    session.run.config.Name,
+		Event:    event,
+		Protocol: utils.UDP,
+		ClientIP: session.client.IP.String(),
+		Backend:  session.backend.Machine.String(),
+	}
+	if event == utils.CloseEvent {
+		entry.Duration = time.Since(session.opened)
+		entry.BytesSent = session.sent.Load()
+		entry.BytesReceived = session.received.Load()
+	}
+	return entry
+}
@@ -0,0 +1,69 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+	"warptail/pkg/utils"
+)
+
+// TestUDPDatagrams checks every datagram reaches the backend and the client
+// on its own, however fast they are sent.
+func TestUDPDatagrams(t *testing.T) {
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, addr, err := backend.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteToUDP(append([]byte("echo "), buf[:n]...), addr)
+		}
+	}()
+	address := backend.LocalAddr().(*net.UDPAddr)
+
+	route := NewUDPRoute(utils.RouteConfig{
+		Name:    "udp.test",
+		Type:    utils.UDP,
+		Machine: utils.Machine{Address: address.IP.String(), Port: uint16(address.Port)},
+		// the session is still open when the test stops the route
+		DrainTimeout: 100 * time.Millisecond,
+	}, nil, nil, nil)
+	route.dial = (&net.Dialer{}).DialContext
+	if err := route.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer route.Stop()
+
+	client, err := net.DialUDP("udp", nil, route.current.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	datagrams := []string{"one", "two", "three"}
+	for _, datagram := range datagrams {
+		if _, err := client.Write([]byte(datagram)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replies := map[string]bool{}
+	buf := make([]byte, udpBufferSize)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for range datagrams {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("got %d of %d replies: %v", len(replies), len(datagrams), err)
+		}
+		replies[string(buf[:n])] = true
+	}
+	for _, datagram := range datagrams {
+		if !replies["echo "+datagram] {
+			t.Errorf("no reply to %q, got %v", datagram, replies)
+		}
+	}
+}
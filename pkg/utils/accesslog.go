@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AccessLogEvent string
+
+const (
+	RequestEvent = AccessLogEvent("request")
+	OpenEvent    = AccessLogEvent("open")
+	CloseEvent   = AccessLogEvent("close")
+)
+
+// AccessLogEntry is a single proxied http request, or the opening or closing
+// of a tcp connection or udp session.
+type AccessLogEntry struct {
+	Time          time.Time
+	Route         string
+	Event         AccessLogEvent
+	Protocol      RouteType
+	ClientIP      string
+	Country       string
+	User          string
+	Backend       string
+	Method        string
+	Host          string
+	Path          string
+	Status        int
+	Duration      time.Duration
+	BytesSent     uint64
+	BytesReceived uint64
+	Error         string
+}
+
+// AccessLogFilter selects entries from an AccessLog. Zero fields match
+// everything. Status is either a code such as "404" or a class like "5xx".
+type AccessLogFilter struct {
+	Since    time.Time
+	Until    time.Time
+	Event    AccessLogEvent
+	Method   string
+	Status   string
+	ClientIP string
+	Country  string
+	Path     string
+	Limit    int
+}
+
+func (filter AccessLogFilter) Match(entry AccessLogEntry) bool {
+	if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && entry.Time.After(filter.Until) {
+		return false
+	}
+	if len(filter.Event) > 0 && entry.Event != filter.Event {
+		return false
+	}
+	if len(filter.Method) > 0 && !strings.EqualFold(entry.Method, filter.Method) {
+		return false
+	}
+	if len(filter.ClientIP) > 0 && entry.ClientIP != filter.ClientIP {
+		return false
+	}
+	if len(filter.Country) > 0 && !strings.EqualFold(entry.Country, filter.Country) {
+		return false
+	}
+	if len(filter.Path) > 0 && !strings.HasPrefix(entry.Path, filter.Path) {
+		return false
+	}
+	if len(filter.Status) > 0 {
+		status := strconv.Itoa(entry.Status)
+		if class := strings.TrimSuffix(strings.ToLower(filter.Status), "xx"); len(class) == 1 {
+			return strings.HasPrefix(status, class) && len(status) == 3
+		}
+		return status == filter.Status
+	}
+	return true
+}
+
+// AccessLogSink receives every entry added to an AccessLog.
+type AccessLogSink interface {
+	Log(entry AccessLogEntry)
+}
+
+// AccessLog keeps the most recent entries of a route in a fixed size ring
+// buffer and forwards them to a sink.
+type AccessLog struct {
+	mu      sync.Mutex
+	entries []AccessLogEntry
+	next    int
+	full    bool
+	sink    AccessLogSink
+}
+
+func NewAccessLog(size int) *AccessLog {
+	return &AccessLog{
+		entries: make([]AccessLogEntry, size),
+	}
+}
+
+func (al *AccessLog) SetSink(sink AccessLogSink) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.sink = sink
+}
+
+func (al *AccessLog) Add(entry AccessLogEntry) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.sink != nil {
+		al.sink.Log(entry)
+	}
+	if len(al.entries) == 0 {
+		return
+	}
+	al.entries[al.next] = entry
+	al.next = (al.next + 1) % len(al.entries)
+	al.full = al.full || al.next == 0
+}
+
+// Query returns the entries matching filter, newest first.
+func (al *AccessLog) Query(filter AccessLogFilter) []AccessLogEntry {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	count := al.next
+	if al.full {
+		count = len(al.entries)
+	}
+	result := []AccessLogEntry{}
+	for i := 1; i <= count; i++ {
+		entry := al.entries[(al.next-i+len(al.entries))%len(al.entries)]
+		if !filter.Match(entry) {
+			continue
+		}
+		result = append(result, entry)
+		if filter.Limit > 0 && len(result) >= filter.Limit {
+			break
+		}
+	}
+	return result
+}
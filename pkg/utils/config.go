@@ -2,8 +2,11 @@ package utils
 
 import (
 	"log"
+	"net"
 	"os"
 	"reflect"
+	"strconv"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -24,11 +27,315 @@ type RouteConfig struct {
 	Type    RouteType `yaml:"type"`
 	Port    int       `yaml:"port,omitempty"`
 	Machine Machine   `yaml:"machine"`
+
+	// IdleTimeout closes UDP client sessions that have seen no traffic for
+	// this long. Zero uses the router default.
+	IdleTimeout time.Duration `yaml:"idle_timeout,omitempty"`
+
+	TLS RouteTLSConfig `yaml:"tls,omitempty"`
+
+	// Paths sends requests of an http route to a different machine based on
+	// the request path. Rules are tried in order, requests matching none of
+	// them go to Machine.
+	Paths []PathRule `yaml:"paths,omitempty"`
+
+	// Backends spreads traffic over several machines using LoadBalancer
+	// instead of sending everything to Machine.
+	Backends     []Machine    `yaml:"backends,omitempty"`
+	LoadBalancer LoadBalancer `yaml:"load_balancer,omitempty"`
+
+	HealthCheck      HealthCheckConfig      `yaml:"health_check,omitempty"`
+	OutlierDetection OutlierDetectionConfig `yaml:"outlier_detection,omitempty"`
+
+	// DialTimeout bounds how long connecting to a backend over the tailnet
+	// may take. Zero uses the router default.
+	DialTimeout time.Duration `yaml:"dial_timeout,omitempty"`
+	// ResponseHeaderTimeout bounds how long an http backend may take to
+	// answer a request with its headers. Zero uses the router default.
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout,omitempty"`
+
+	Retry RetryPolicy `yaml:"retry,omitempty"`
+
+	// DrainTimeout is how long open connections and in flight requests may
+	// keep going after the route is stopped or updated before they are
+	// closed. Zero uses the router default.
+	DrainTimeout time.Duration `yaml:"drain_timeout,omitempty"`
+
+	// ProxyProtocol sends the client address to the backend in a PROXY
+	// protocol header of this version on every connection, or every
+	// datagram of a udp route.
+	ProxyProtocol ProxyProtocol `yaml:"proxy_protocol,omitempty"`
+
+	Limits    ConnectionLimits `yaml:"limits,omitempty"`
+	RateLimit RateLimitConfig  `yaml:"rate_limit,omitempty"`
+	Access    AccessConfig     `yaml:"access,omitempty"`
+	Auth      AuthConfig       `yaml:"auth,omitempty"`
+}
+
+// Machines returns the backend pool of the route, which is just Machine
+// when no backends are configured. It is empty for http routes that only
+// send their path rules somewhere.
+func (config RouteConfig) Machines() []Machine {
+	if len(config.Backends) > 0 {
+		return config.Backends
+	}
+	if len(config.Machine.Address) == 0 {
+		return nil
+	}
+	return []Machine{config.Machine}
+}
+
+type ProxyProtocol string
+
+const (
+	ProxyProtocolV1 = ProxyProtocol("v1")
+	ProxyProtocolV2 = ProxyProtocol("v2")
+)
+
+type LoadBalancer string
+
+const (
+	RoundRobin       = LoadBalancer("round_robin")
+	LeastConnections = LoadBalancer("least_connections")
+	Random           = LoadBalancer("random")
+	ConsistentHash   = LoadBalancer("consistent_hash")
+)
+
+type PathMatch string
+
+const (
+	PathPrefix = PathMatch("prefix")
+	PathExact  = PathMatch("exact")
+	PathRegex  = PathMatch("regex")
+)
+
+type PathRule struct {
+	Path    string    `yaml:"path"`
+	Match   PathMatch `yaml:"match,omitempty"`
+	Machine Machine   `yaml:"machine"`
+}
+
+// RouteTLSConfig points an https route at the PEM encoded certificate and
+// key served for its name. When empty the certificate is requested over ACME.
+type RouteTLSConfig struct {
+	CertFile   string           `yaml:"cert_file,omitempty"`
+	KeyFile    string           `yaml:"key_file,omitempty"`
+	ClientAuth ClientAuthConfig `yaml:"client_auth,omitempty"`
+}
+
+type ClientAuthMode string
+
+const (
+	ClientAuthRequire  = ClientAuthMode("require")
+	ClientAuthOptional = ClientAuthMode("optional")
+)
+
+// ClientAuthConfig asks clients of an https route for a certificate issued
+// by a CA in CAFile. Mode "require" (the default) refuses clients without
+// one, "optional" only refuses invalid ones. Certificates listed in the PEM
+// or DER encoded CRLFile are refused, the file is reread when it changes.
+type ClientAuthConfig struct {
+	CAFile  string         `yaml:"ca_file,omitempty"`
+	Mode    ClientAuthMode `yaml:"mode,omitempty"`
+	CRLFile string         `yaml:"crl_file,omitempty"`
+}
+
+type HealthCheckType string
+
+const (
+	TCPHealthCheck  = HealthCheckType("tcp")
+	HTTPHealthCheck = HealthCheckType("http")
+)
+
+// HealthCheckConfig actively probes every backend of a route. Backends are
+// marked unhealthy after UnhealthyThreshold failed checks in a row and
+// healthy again after HealthyThreshold successful ones. No checks are run
+// when Type is empty.
+type HealthCheckConfig struct {
+	Type               HealthCheckType `yaml:"type,omitempty"`
+	Interval           time.Duration   `yaml:"interval,omitempty"`
+	Timeout            time.Duration   `yaml:"timeout,omitempty"`
+	Port               uint16          `yaml:"port,omitempty"`
+	Path               string          `yaml:"path,omitempty"`
+	ExpectedStatus     int             `yaml:"expected_status,omitempty"`
+	ExpectedBody       string          `yaml:"expected_body,omitempty"`
+	HealthyThreshold   int             `yaml:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int             `yaml:"unhealthy_threshold,omitempty"`
+}
+
+// OutlierDetectionConfig ejects a backend from rotation after
+// ConsecutiveFailures dial failures, timeouts or 5xx responses in a row. The
+// ejection starts at BaseEjectionTime and doubles every time the backend
+// fails again, up to MaxEjectionTime. Disabled when ConsecutiveFailures is 0.
+type OutlierDetectionConfig struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures,omitempty"`
+	BaseEjectionTime    time.Duration `yaml:"base_ejection_time,omitempty"`
+	MaxEjectionTime     time.Duration `yaml:"max_ejection_time,omitempty"`
+}
+
+// RetryPolicy retries failed requests of an http route, on another backend
+// when there is one. Only idempotent requests with a body of at most
+// MaxBodySize bytes are retried. RetryOn lists the failures worth retrying:
+// "connect-failure", "timeout", "reset", "5xx", "gateway-error" (502, 503
+// and 504) or a status code such as "429". It defaults to connect-failure
+// and gateway-error. Disabled when Attempts is less than 2.
+type RetryPolicy struct {
+	Attempts      int           `yaml:"attempts,omitempty"`
+	PerTryTimeout time.Duration `yaml:"per_try_timeout,omitempty"`
+	RetryOn       []string      `yaml:"retry_on,omitempty"`
+	MaxBodySize   int64         `yaml:"max_body_size,omitempty"`
+}
+
+// ConnectionLimits bound the concurrent connections of a tcp route, client
+// sessions of a udp route or in flight requests of an http route, in total
+// and per client IP. Zero means unlimited.
+type ConnectionLimits struct {
+	MaxConnections      int `yaml:"max_connections,omitempty"`
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip,omitempty"`
+}
+
+// RateLimitConfig throttles a route with token buckets refilled at the
+// given rate and holding up to Burst tokens. RequestsPerSecond applies per
+// client IP of an http route, ConnectionsPerSecond to new connections of a
+// tcp route and BytesPerSecond to the traffic of a tcp route in each
+// direction. Zero means unlimited.
+type RateLimitConfig struct {
+	RequestsPerSecond    float64 `yaml:"requests_per_second,omitempty"`
+	ConnectionsPerSecond float64 `yaml:"connections_per_second,omitempty"`
+	Burst                int     `yaml:"burst,omitempty"`
+	BytesPerSecond       int64   `yaml:"bytes_per_second,omitempty"`
+}
+
+// AccessConfig restricts which client addresses may use a route. Entries
+// are IPv4 or IPv6 addresses or CIDR ranges, ISO 3166 country codes and
+// autonomous system numbers, the latter two need a GeoIP database. Deny
+// always wins, when any allow list is set only clients matching one of its
+// entries get through.
+type AccessConfig struct {
+	Allow          []string `yaml:"allow,omitempty"`
+	Deny           []string `yaml:"deny,omitempty"`
+	AllowCountries []string `yaml:"allow_countries,omitempty"`
+	DenyCountries  []string `yaml:"deny_countries,omitempty"`
+	AllowASNs      []uint   `yaml:"allow_asns,omitempty"`
+	DenyASNs       []uint   `yaml:"deny_asns,omitempty"`
+}
+
+// AuthConfig puts authentication in front of an http or https route. Only
+// one kind of authentication may be configured per route, except for JWT
+// and APIKeys which may be combined so either credential is accepted.
+type AuthConfig struct {
+	Basic   BasicAuthConfig   `yaml:"basic,omitempty"`
+	OIDC    OIDCConfig        `yaml:"oidc,omitempty"`
+	Forward ForwardAuthConfig `yaml:"forward,omitempty"`
+	JWT     JWTAuthConfig     `yaml:"jwt,omitempty"`
+	APIKeys APIKeyAuthConfig  `yaml:"api_keys,omitempty"`
+}
+
+// BasicAuthConfig asks for a username and password. Users maps usernames to
+// bcrypt hashes, HtpasswdFile points at an htpasswd file with bcrypt entries
+// as written by htpasswd -B. Both may be set.
+type BasicAuthConfig struct {
+	Realm        string            `yaml:"realm,omitempty"`
+	Users        map[string]string `yaml:"users,omitempty"`
+	HtpasswdFile string            `yaml:"htpasswd_file,omitempty"`
+}
+
+// OIDCConfig signs visitors in with an OpenID Connect provider. Issuer is
+// the provider's base URL, its discovery document is read from
+// Issuer/.well-known/openid-configuration. The redirect URL to register at
+// the provider is https://<route name>/.warptail/oidc/callback.
+//
+// Signed in visitors get a session cookie signed with CookieSecret, a
+// random secret is used when it is empty so sessions end with a restart.
+// AllowedEmails holds addresses or "@domain" suffixes and AllowedGroups
+// the groups read from GroupsClaim (default "groups"), a visitor matching
+// either list is let in. When both are empty anyone the provider signs in
+// is. ForwardHeaders passes the identity to the backend as X-Forwarded-User,
+// X-Forwarded-Email and X-Forwarded-Groups.
+type OIDCConfig struct {
+	Issuer          string        `yaml:"issuer,omitempty"`
+	ClientID        string        `yaml:"client_id,omitempty"`
+	ClientSecret    string        `yaml:"client_secret,omitempty"`
+	Scopes          []string      `yaml:"scopes,omitempty"`
+	CookieSecret    string        `yaml:"cookie_secret,omitempty"`
+	SessionDuration time.Duration `yaml:"session_duration,omitempty"`
+	AllowedEmails   []string      `yaml:"allowed_emails,omitempty"`
+	AllowedGroups   []string      `yaml:"allowed_groups,omitempty"`
+	GroupsClaim     string        `yaml:"groups_claim,omitempty"`
+	ForwardHeaders  bool          `yaml:"forward_headers,omitempty"`
+}
+
+// ForwardAuthConfig asks an auth server such as Authelia or Authentik about
+// every request. Address gets the request's headers along with
+// X-Forwarded-Method, -Proto, -Host, -Uri and -For. A 2xx answer lets the
+// request through with the ResponseHeaders of the answer copied onto it and
+// the user read from UserHeader (default Remote-User), any other answer is
+// sent to the client as is.
+type ForwardAuthConfig struct {
+	Address         string        `yaml:"address,omitempty"`
+	ResponseHeaders []string      `yaml:"response_headers,omitempty"`
+	UserHeader      string        `yaml:"user_header,omitempty"`
+	Timeout         time.Duration `yaml:"timeout,omitempty"`
+}
+
+// JWTAuthConfig accepts requests with a bearer token signed by one of the
+// keys from JWKSURL, which is cached for JWKSCacheDuration (default 1h) and
+// refetched early when a token names an unknown key, from KeyFiles (PEM
+// public keys or certificates, or JWKS documents) or with the HMAC Secret.
+// Tokens must not be expired and match Issuer, one of Audience and every
+// RequiredClaims value, a claim holding a list or space separated scopes
+// matches when it contains the value. The user is read from UserClaim
+// (default "sub").
+type JWTAuthConfig struct {
+	JWKSURL           string            `yaml:"jwks_url,omitempty"`
+	JWKSCacheDuration time.Duration     `yaml:"jwks_cache_duration,omitempty"`
+	KeyFiles          []string          `yaml:"key_files,omitempty"`
+	Secret            string            `yaml:"secret,omitempty"`
+	Issuer            string            `yaml:"issuer,omitempty"`
+	Audience          []string          `yaml:"audience,omitempty"`
+	RequiredClaims    map[string]string `yaml:"required_claims,omitempty"`
+	UserClaim         string            `yaml:"user_claim,omitempty"`
+	Leeway            time.Duration     `yaml:"leeway,omitempty"`
+}
+
+// APIKeyAuthConfig accepts requests carrying a known key in Header (default
+// X-API-Key). Keys maps a name, which becomes the user, to the hex encoded
+// SHA-256 hash of the key.
+type APIKeyAuthConfig struct {
+	Header string            `yaml:"header,omitempty"`
+	Keys   map[string]string `yaml:"keys,omitempty"`
 }
 
 type Machine struct {
 	Address string `yaml:"address"`
 	Port    uint16 `yaml:"port"`
+
+	// Scheme is "https" for http routes or "tls" for tcp routes to reach
+	// the machine over TLS, empty means plain http or tcp.
+	Scheme string           `yaml:"scheme,omitempty"`
+	TLS    MachineTLSConfig `yaml:"tls,omitempty"`
+}
+
+// MachineTLSConfig is how warptail connects to a machine over TLS. The
+// certificate is checked for ServerName (default the machine address)
+// against the CAs in CAFile, or the system roots when it is empty, unless
+// InsecureSkipVerify is set. CertFile and KeyFile hold a client certificate
+// for machines that require one.
+type MachineTLSConfig struct {
+	ServerName         string `yaml:"server_name,omitempty"`
+	CAFile             string `yaml:"ca_file,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+}
+
+// Secure reports whether the machine is reached over TLS.
+func (machine Machine) Secure() bool {
+	return machine.Scheme == "https" || machine.Scheme == "tls"
+}
+
+func (machine Machine) String() string {
+	return net.JoinHostPort(machine.Address, strconv.Itoa(int(machine.Port)))
 }
 
 type DashboardConfig struct {
@@ -42,6 +349,68 @@ type TailscaleConfig struct {
 	Hostname string `yaml:"hostnmae"`
 }
 
+type TLSConfig struct {
+	Listen string     `yaml:"listen,omitempty"`
+	ACME   ACMEConfig `yaml:"acme,omitempty"`
+}
+
+// ACMEConfig enables certificates from an ACME CA for every http and https
+// route. DirectoryURL defaults to Let's Encrypt, CAFile is only needed when
+// the CA itself uses a private certificate such as a local Pebble server.
+type ACMEConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	Email        string `yaml:"email,omitempty"`
+	DirectoryURL string `yaml:"directory_url,omitempty"`
+	CacheDir     string `yaml:"cache_dir,omitempty"`
+	CAFile       string `yaml:"ca_file,omitempty"`
+}
+
+// GeoIPConfig points at MaxMind format (.mmdb) databases used to look up
+// the country and autonomous system of clients, such as GeoLite2-Country
+// and GeoLite2-ASN. A single database holding both may be set for both.
+type GeoIPConfig struct {
+	CountryDatabase string `yaml:"country_database,omitempty"`
+	ASNDatabase     string `yaml:"asn_database,omitempty"`
+}
+
+type LogSinkType string
+
+const (
+	FileSink   = LogSinkType("file")
+	SyslogSink = LogSinkType("syslog")
+	StdoutSink = LogSinkType("stdout")
+)
+
+type LogFormat string
+
+const (
+	CommonLogFormat = LogFormat("clf")
+	JSONLogFormat   = LogFormat("json")
+)
+
+// LogSinkConfig ships access logs of every route out of warptail.
+//
+// File sinks write to Path and rotate it once it grows past MaxSize
+// megabytes or is older than RotateEvery, rotated files older than MaxAge
+// are deleted. Syslog sinks send RFC 5424 messages to Address over Network
+// ("udp", "tcp", "unix" or "unixgram").
+type LogSinkConfig struct {
+	Type        LogSinkType   `yaml:"type"`
+	Format      LogFormat     `yaml:"format,omitempty"`
+	Path        string        `yaml:"path,omitempty"`
+	MaxSize     int           `yaml:"max_size,omitempty"`
+	RotateEvery time.Duration `yaml:"rotate_every,omitempty"`
+	MaxAge      time.Duration `yaml:"max_age,omitempty"`
+	Network     string        `yaml:"network,omitempty"`
+	Address     string        `yaml:"address,omitempty"`
+	Facility    int           `yaml:"facility,omitempty"`
+	Tag         string        `yaml:"tag,omitempty"`
+}
+
+type LoggingConfig struct {
+	Sinks []LogSinkConfig `yaml:"sinks,omitempty"`
+}
+
 type K8Config struct {
 	Namespace    string `yaml:"namespace"`
 	IngressName  string `yaml:"ingress_name"`
@@ -52,8 +421,14 @@ type K8Config struct {
 type Config struct {
 	Tailscale TailscaleConfig `yaml:"tailscale"`
 	Dasboard  DashboardConfig `yaml:"dashboard"`
-	K8Config  K8Config        `yaml:"kubernetes,omitempty"`
-	Routes    []RouteConfig   `yaml:"routes"`
+	TLS       TLSConfig       `yaml:"tls,omitempty"`
+	Logging   LoggingConfig   `yaml:"logging,omitempty"`
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies in
+	// front of warptail whose X-Forwarded-For header is believed.
+	TrustedProxies []string      `yaml:"trusted_proxies,omitempty"`
+	GeoIP          GeoIPConfig   `yaml:"geoip,omitempty"`
+	K8Config       K8Config      `yaml:"kubernetes,omitempty"`
+	Routes         []RouteConfig `yaml:"routes"`
 }
 
 func LoadConfig() Config {
@@ -48,15 +48,13 @@ func (tsd *TimeSeriesData) Add(point ProxyStats) {
 	} else {
 		tsd.Points = append(tsd.Points, DataPoint{Timestamp: now, Value: point})
 	}
+	tsd.Total.Sent += point.Sent
+	tsd.Total.Received += point.Received
 	if len(tsd.Points) > tsd.maxSize {
+		tsd.Total.Sent -= tsd.Points[0].Value.Sent
+		tsd.Total.Received -= tsd.Points[0].Value.Received
 		tsd.Points = tsd.Points[1:]
 	}
-	ps := ProxyStats{Sent: 0, Received: 0}
-	for _, stat := range tsd.Points {
-		ps.Received += stat.Value.Received
-		ps.Sent += stat.Value.Sent
-	}
-	tsd.Total = ps
 }
 
 func (ts *TimeSeries) LogSent(value uint64) {
@@ -70,3 +68,28 @@ func (ts *TimeSeries) LogRecived(value uint64) {
 	defer ts.mu.Unlock()
 	ts.Data.Add(ProxyStats{Received: value})
 }
+
+// Snapshot returns a copy of the data that is safe to use while traffic is
+// still being logged.
+func (ts *TimeSeries) Snapshot() TimeSeriesData {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	data := ts.Data
+	data.Points = append(make([]DataPoint, 0, len(ts.Data.Points)), ts.Data.Points...)
+	return data
+}
+
+// At returns the traffic logged in the bucket containing t.
+func (ts *TimeSeries) At(t time.Time) ProxyStats {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t = t.Truncate(ts.Data.bucket)
+	for i := len(ts.Data.Points) - 1; i >= 0; i-- {
+		if point := ts.Data.Points[i]; point.Timestamp.Equal(t) {
+			return point.Value
+		} else if point.Timestamp.Before(t) {
+			break
+		}
+	}
+	return ProxyStats{}
+}